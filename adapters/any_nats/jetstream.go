@@ -0,0 +1,166 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package any_nats
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"sustainyfacts.dev/anycache/cache"
+)
+
+type JetStreamConfig struct {
+	Stream  string // Name of the stream, created if it does not exist
+	Subject string // Subject of the messages
+
+	// Retention of the messages in the stream
+	MaxAge   time.Duration
+	MaxMsgs  int64
+	Replicas int
+
+	// Name of the durable consumer of the node, which must be unique in the cluster.
+	// The server keeps the messages acknowledged by the node, so that a node that
+	// restarts receives the messages it missed.
+	// Without name, an ordered consumer is used, that receives the messages missed
+	// while disconnected, but not the messages sent while the node was stopped.
+	Durable string
+
+	// Messages sent during that period before the subscription are replayed. Only
+	// for new consumers, a durable consumer resumes from its last acknowledged message.
+	ReplayFrom time.Duration
+
+	Timeout time.Duration // Of the calls to the server
+}
+
+var DefaultJetStreamConfig = JetStreamConfig{
+	Stream:  "ANYCACHE",
+	Subject: "anycache.invalidations",
+	MaxAge:  time.Hour,
+	Timeout: 5 * time.Second,
+}
+
+// JetStreamBroker is a cache.MessageBroker persisting the messages in a
+// JetStream stream, so that the messages sent while a node was disconnected
+// or restarting are not lost.
+type JetStreamBroker struct {
+	js     jetstream.JetStream
+	stream jetstream.Stream
+	config JetStreamConfig
+}
+
+// NewJetStreamAdapter creates a broker on a JetStream stream, creating or
+// updating the stream with the retention of the configuration
+func NewJetStreamAdapter(nc *nats.Conn, config JetStreamConfig) (*JetStreamBroker, error) {
+	if config.Stream == "" {
+		config.Stream = DefaultJetStreamConfig.Stream
+	}
+	if config.Subject == "" {
+		config.Subject = DefaultJetStreamConfig.Subject
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultJetStreamConfig.Timeout
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     config.Stream,
+		Subjects: []string{config.Subject},
+		MaxAge:   config.MaxAge,
+		MaxMsgs:  config.MaxMsgs,
+		Replicas: config.Replicas,
+		Storage:  jetstream.FileStorage,
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Connected to NATS JetStream, stream %s", config.Stream)
+	return &JetStreamBroker{js: js, stream: stream, config: config}, nil
+}
+
+// Implement Cache.MessageBroker. Returns once the message is stored by the server.
+func (b *JetStreamBroker) Send(msg []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.Timeout)
+	defer cancel()
+	_, err := b.js.Publish(ctx, b.config.Subject, msg)
+	return err
+}
+
+// Implement Cache.MessageBroker. With a durable consumer, the broker must be
+// subscribed only once, otherwise the messages are split between the subscriptions.
+func (b *JetStreamBroker) Subscribe(messageHandler func(message []byte)) (io.Closer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.Timeout)
+	defer cancel()
+
+	deliver := jetstream.DeliverNewPolicy
+	var start *time.Time
+	if b.config.ReplayFrom > 0 {
+		t := time.Now().Add(-b.config.ReplayFrom)
+		deliver, start = jetstream.DeliverByStartTimePolicy, &t
+	}
+
+	var consumer jetstream.Consumer
+	var err error
+	if b.config.Durable != "" {
+		// Resumes from its last acknowledged message if it exists
+		consumer, err = b.stream.Consumer(ctx, b.config.Durable)
+	}
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		consumer, err = b.stream.CreateConsumer(ctx, jetstream.ConsumerConfig{
+			Durable:       b.config.Durable,
+			DeliverPolicy: deliver,
+			OptStartTime:  start,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			FilterSubject: b.config.Subject,
+		})
+	} else if b.config.Durable == "" {
+		consumer, err = b.stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+			DeliverPolicy:  deliver,
+			OptStartTime:   start,
+			FilterSubjects: []string{b.config.Subject},
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	consumeContext, err := consumer.Consume(func(msg jetstream.Msg) {
+		messageHandler(msg.Data())
+		if b.config.Durable != "" {
+			if err := msg.Ack(); err != nil {
+				log.Printf("Warn - cannot acknowledge message: %v", err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	var cf closerFunc = func() error {
+		consumeContext.Stop()
+		return nil
+	}
+	return cf, nil
+}
+
+var _ cache.MessageBroker = (*JetStreamBroker)(nil)
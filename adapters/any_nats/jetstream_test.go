@@ -0,0 +1,126 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package any_nats
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts an embedded NATS server with JetStream, and connects to it
+func runJetStream(t *testing.T) *nats.Conn {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+type received struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *received) handler(msg []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, string(msg))
+}
+
+func (r *received) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.messages...)
+}
+
+func TestJetStream(t *testing.T) {
+	nc := runJetStream(t)
+	broker, err := NewJetStreamAdapter(nc, DefaultJetStreamConfig)
+	assert.NoError(t, err)
+
+	r := &received{}
+	closer, err := broker.Subscribe(r.handler)
+	assert.NoError(t, err)
+	defer closer.Close()
+
+	assert.NoError(t, broker.Send([]byte("1")))
+	assert.NoError(t, broker.Send([]byte("2")))
+	assert.Eventually(t, func() bool { return len(r.get()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"1", "2"}, r.get(), "messages received in order")
+}
+
+func TestJetStreamDurable(t *testing.T) {
+	nc := runJetStream(t)
+	config := DefaultJetStreamConfig
+	config.Durable = "node-1"
+	broker, err := NewJetStreamAdapter(nc, config)
+	assert.NoError(t, err)
+
+	r := &received{}
+	closer, err := broker.Subscribe(r.handler)
+	assert.NoError(t, err)
+	broker.Send([]byte("1"))
+	assert.Eventually(t, func() bool { return len(r.get()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	closer.Close()
+
+	// Sent while the node is stopped
+	broker.Send([]byte("2"))
+	broker.Send([]byte("3"))
+
+	r = &received{}
+	closer, err = broker.Subscribe(r.handler)
+	assert.NoError(t, err)
+	defer closer.Close()
+	assert.Eventually(t, func() bool { return len(r.get()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"2", "3"}, r.get(), "missed messages received after restart")
+}
+
+func TestJetStreamReplay(t *testing.T) {
+	nc := runJetStream(t)
+	broker, err := NewJetStreamAdapter(nc, DefaultJetStreamConfig)
+	assert.NoError(t, err)
+	broker.Send([]byte("before"))
+
+	config := DefaultJetStreamConfig
+	config.ReplayFrom = time.Minute
+	replaying, err := NewJetStreamAdapter(nc, config)
+	assert.NoError(t, err)
+	r := &received{}
+	closer, err := replaying.Subscribe(r.handler)
+	assert.NoError(t, err)
+	defer closer.Close()
+	broker.Send([]byte("after"))
+
+	assert.Eventually(t, func() bool { return len(r.get()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"before", "after"}, r.get(), "messages of the period replayed")
+}
@@ -0,0 +1,346 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package any_nats
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"sustainyfacts.dev/anycache/cache"
+)
+
+// ValueCodec encodes the values stored in the KV buckets
+type ValueCodec interface {
+	Marshal(value any) ([]byte, error)
+	Unmarshal(data []byte, valueType reflect.Type) (any, error)
+}
+
+// JSONValueCodec stores the values in JSON
+var JSONValueCodec ValueCodec = jsonValueCodec{}
+
+type jsonValueCodec struct{}
+
+func (jsonValueCodec) Marshal(value any) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonValueCodec) Unmarshal(data []byte, valueType reflect.Type) (any, error) {
+	v := reflect.New(valueType)
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+type KVConfig struct {
+	BucketPrefix string // Buckets are named with the prefix and the name of the group
+	Storage      jetstream.StorageType
+	Replicas     int
+	ValueCodec   ValueCodec
+
+	// Bucket used to send the invalidation messages, and retention of the messages
+	MessagesBucket string
+	MessagesTTL    time.Duration
+
+	Timeout time.Duration // Of the calls to the server
+}
+
+var DefaultKVConfig = KVConfig{
+	BucketPrefix:   "anycache_",
+	Storage:        jetstream.FileStorage,
+	ValueCodec:     JSONValueCodec,
+	MessagesBucket: "anycache_messages",
+	MessagesTTL:    time.Minute,
+	Timeout:        5 * time.Second,
+}
+
+// KVStore is a cache.BrokerStore storing the entries of each group in a
+// JetStream KV bucket, with the TTL of the group. The invalidation messages are
+// sent through another bucket, whose watchers receive the messages.
+type KVStore struct {
+	js     jetstream.JetStream
+	config KVConfig
+
+	mu      sync.Mutex
+	configs map[string]cache.GroupConfig
+	buckets map[string]jetstream.KeyValue
+}
+
+var (
+	_ cache.BrokerStore = (*KVStore)(nil)
+	_ cache.Clearer     = (*KVStore)(nil)
+	_ cache.PrefixStore = (*KVStore)(nil)
+)
+
+// NewKVAdapter creates a store on the JetStream KV buckets of the server
+func NewKVAdapter(nc *nats.Conn, config KVConfig) (*KVStore, error) {
+	if config.BucketPrefix == "" {
+		config.BucketPrefix = DefaultKVConfig.BucketPrefix
+	}
+	if config.ValueCodec == nil {
+		config.ValueCodec = DefaultKVConfig.ValueCodec
+	}
+	if config.MessagesBucket == "" {
+		config.MessagesBucket = DefaultKVConfig.MessagesBucket
+	}
+	if config.MessagesTTL <= 0 {
+		config.MessagesTTL = DefaultKVConfig.MessagesTTL
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultKVConfig.Timeout
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return nil, err
+	}
+	s := &KVStore{js: js, config: config,
+		configs: make(map[string]cache.GroupConfig), buckets: make(map[string]jetstream.KeyValue)}
+	if _, err := s.messages(); err != nil {
+		return nil, err
+	}
+	log.Printf("Connected to NATS JetStream KV, version %s", nc.ConnectedServerVersion())
+	return s, nil
+}
+
+// Implement cache.Store. The bucket of the group is created, or updated with the TTL of the group.
+func (s *KVStore) ConfigureGroup(name string, config cache.GroupConfig) {
+	if config.Cost != 0 {
+		panic("NATS does not support Cost")
+	}
+	s.mu.Lock()
+	s.configs[name] = config
+	s.mu.Unlock()
+	if _, err := s.bucket(name); err != nil {
+		log.Printf("Warn - cannot create bucket for group %s: %v", name, err) // Created on first use
+	}
+}
+
+func (s *KVStore) Get(key cache.GroupKey) (any, error) {
+	kv, err := s.bucket(key.GroupName)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	entry, err := kv.Get(ctx, key.StoreKey.(string))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, cache.ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	valueType := s.configs[key.GroupName].ValueType
+	s.mu.Unlock()
+	return s.config.ValueCodec.Unmarshal(entry.Value(), valueType)
+}
+
+func (s *KVStore) Set(key cache.GroupKey, value any) error {
+	kv, err := s.bucket(key.GroupName)
+	if err != nil {
+		return err
+	}
+	data, err := s.config.ValueCodec.Marshal(value)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	_, err = kv.Put(ctx, key.StoreKey.(string), data)
+	return err
+}
+
+func (s *KVStore) Del(key cache.GroupKey) error {
+	kv, err := s.bucket(key.GroupName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	return kv.Purge(ctx, key.StoreKey.(string))
+}
+
+func (s *KVStore) Key(groupName string, key any) cache.GroupKey {
+	storeKey := escapeKey(fmt.Sprintf("%v", key))
+	if storeKey == "" {
+		storeKey = "=" // Keys cannot be empty
+	}
+	return cache.GroupKey{GroupName: groupName, StoreKey: storeKey}
+}
+
+// Implement cache.Clearer
+func (s *KVStore) Clear(groupName string) {
+	if err := s.DelPrefix(groupName, ""); err != nil {
+		log.Printf("Warn - cannot clear group %s: %v", groupName, err)
+	}
+}
+
+// Implement cache.PrefixStore. Lists the keys of the bucket and purges the
+// ones starting with the prefix.
+func (s *KVStore) DelPrefix(groupName string, prefix string) error {
+	kv, err := s.bucket(groupName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	lister, err := kv.ListKeys(ctx)
+	if err != nil {
+		return err
+	}
+	escaped := escapeKey(prefix)
+	var errs []error
+	for k := range lister.Keys() {
+		if strings.HasPrefix(k, escaped) {
+			if err := kv.Purge(ctx, k); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Implement cache.MessageBroker. The message is stored with a unique key in
+// the messages bucket, and expires after MessagesTTL.
+func (s *KVStore) Send(msg []byte) error {
+	kv, err := s.messages()
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	ctx, cancel := s.context()
+	defer cancel()
+	_, err = kv.Put(ctx, hex.EncodeToString(id), msg)
+	return err
+}
+
+// Implement cache.MessageBroker. Watches the new entries of the messages bucket.
+func (s *KVStore) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	kv, err := s.messages()
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := kv.WatchAll(context.Background(), jetstream.UpdatesOnly(), jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				handler(entry.Value())
+			}
+		}
+	}()
+	var cf closerFunc = func() error {
+		return watcher.Stop()
+	}
+	return cf, nil
+}
+
+// Bucket of the group, created if needed
+func (s *KVStore) bucket(groupName string) (jetstream.KeyValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kv, ok := s.buckets[groupName]; ok {
+		return kv, nil
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	kv, err := s.js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:   bucketName(s.config.BucketPrefix, groupName),
+		TTL:      s.configs[groupName].Ttl,
+		Storage:  s.config.Storage,
+		Replicas: s.config.Replicas,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.buckets[groupName] = kv
+	return kv, nil
+}
+
+func (s *KVStore) messages() (jetstream.KeyValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kv, ok := s.buckets[""]; ok {
+		return kv, nil
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+	kv, err := s.js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:   s.config.MessagesBucket,
+		TTL:      s.config.MessagesTTL,
+		Storage:  s.config.Storage,
+		Replicas: s.config.Replicas,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.buckets[""] = kv // No group has an empty name
+	return kv, nil
+}
+
+func (s *KVStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.config.Timeout)
+}
+
+// Bucket names only allow letters, digits, '-' and '_'. Names with other
+// characters are suffixed with a hash of the name, so they stay unique.
+func bucketName(prefix string, groupName string) string {
+	valid := true
+	name := strings.Map(func(r rune) rune {
+		if r < 128 && (r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return r
+		}
+		valid = false
+		return '_'
+	}, groupName)
+	if valid {
+		return prefix + name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(groupName))
+	return fmt.Sprintf("%s%s_%08x", prefix, name, h.Sum32())
+}
+
+// Keys only allow letters, digits and '-', '/', '_', '='. The other bytes, '='
+// and '.' (token separator), are escaped as =XX, so that the prefix of a key is
+// the prefix of the escaped key.
+func escapeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c == '-' || c == '/' || c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "=%02X", c)
+		}
+	}
+	return b.String()
+}
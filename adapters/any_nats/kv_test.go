@@ -0,0 +1,92 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package any_nats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"sustainyfacts.dev/anycache/cache"
+)
+
+type kvValue struct {
+	Name  string
+	Count int
+}
+
+func TestKVStore(t *testing.T) {
+	nc := runJetStream(t)
+	store, err := NewKVAdapter(nc, DefaultKVConfig)
+	assert.NoError(t, err)
+	store.ConfigureGroup("kv@v2", cache.GroupConfig{Ttl: time.Minute, ValueType: reflect.TypeOf(kvValue{})})
+
+	key := store.Key("kv@v2", "a.b c")
+	_, err = store.Get(key)
+	assert.ErrorIs(t, err, cache.ErrKeyNotFound)
+
+	assert.NoError(t, store.Set(key, kvValue{"name", 42}))
+	v, err := store.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, kvValue{"name", 42}, v, "value decoded to the type of the group")
+
+	assert.NoError(t, store.Del(key))
+	_, err = store.Get(key)
+	assert.ErrorIs(t, err, cache.ErrKeyNotFound)
+}
+
+func TestKVStorePrefix(t *testing.T) {
+	nc := runJetStream(t)
+	store, err := NewKVAdapter(nc, DefaultKVConfig)
+	assert.NoError(t, err)
+	store.ConfigureGroup("prefix", cache.GroupConfig{ValueType: reflect.TypeOf("")})
+
+	for _, k := range []string{"user.1", "user.2", "users", "other"} {
+		assert.NoError(t, store.Set(store.Key("prefix", k), k))
+	}
+	assert.NoError(t, store.DelPrefix("prefix", "user."))
+	for k, found := range map[string]bool{"user.1": false, "user.2": false, "users": true, "other": true} {
+		_, err := store.Get(store.Key("prefix", k))
+		assert.Equal(t, found, err == nil, k)
+	}
+
+	store.Clear("prefix")
+	_, err = store.Get(store.Key("prefix", "other"))
+	assert.ErrorIs(t, err, cache.ErrKeyNotFound)
+}
+
+func TestKVStoreBroker(t *testing.T) {
+	nc := runJetStream(t)
+	store, err := NewKVAdapter(nc, DefaultKVConfig)
+	assert.NoError(t, err)
+
+	r := &received{}
+	closer, err := store.Subscribe(r.handler)
+	assert.NoError(t, err)
+	defer closer.Close()
+
+	assert.NoError(t, store.Send([]byte("1")))
+	assert.NoError(t, store.Send([]byte("2")))
+	assert.Eventually(t, func() bool { return len(r.get()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"1", "2"}, r.get(), "messages received in order")
+}
+
+func TestBucketName(t *testing.T) {
+	assert.Equal(t, "anycache_group-1", bucketName("anycache_", "group-1"))
+	assert.NotEqual(t, bucketName("anycache_", "group@v1"), bucketName("anycache_", "group#v1"), "names stay unique")
+	assert.Equal(t, "a=2Eb=3D=20c", escapeKey("a.b= c"))
+}
@@ -18,6 +18,7 @@ package any_nats
 import (
 	"io"
 	"log"
+	"sync"
 
 	"github.com/nats-io/nats.go"
 	"sustainyfacts.dev/anycache/cache"
@@ -26,6 +27,10 @@ import (
 type NatsBroker struct {
 	conn  *nats.Conn
 	topic string
+
+	handlersMu  sync.Mutex
+	handlers    map[uint64]func(event cache.ConnectionEvent) // Connection events handlers, by id
+	nextHandler uint64
 }
 
 func NewAdapter(urls, topic string, options ...nats.Option) (cache.MessageBroker, error) {
@@ -34,26 +39,71 @@ func NewAdapter(urls, topic string, options ...nats.Option) (cache.MessageBroker
 	if err != nil {
 		return nil, err
 	}
-	version := nc.ConnectedServerVersion()
-	log.Printf("Connected to NATS, version %s", version)
-	return &NatsBroker{conn: nc, topic: topic}, nil
+	return NewAdapterWithClient(nc, topic)
 }
 
 // Creates a new adapter for NATS with nats.Conn given as parameter
 func NewAdapterWithClient(nc *nats.Conn, topic string) (cache.MessageBroker, error) {
 	version := nc.ConnectedServerVersion()
 	log.Printf("Connected to NATS, version %s", version)
-	return &NatsBroker{conn: nc, topic: topic}, nil
+	b := &NatsBroker{conn: nc, topic: topic}
+	b.watchConnection()
+	return b, nil
 }
 
-// Implement Cache.MessageBroker
-func (b *NatsBroker) Send(msg []byte) error {
-	err := b.conn.Publish(b.topic, msg)
-	if err != nil {
-		return err
+// Reports the connection events, keeping the handlers already set on the connection
+func (b *NatsBroker) watchConnection() {
+	disconnected := b.conn.Opts.DisconnectedErrCB
+	b.conn.SetDisconnectErrHandler(func(nc *nats.Conn, err error) {
+		b.notify(cache.Disconnected)
+		if disconnected != nil {
+			disconnected(nc, err)
+		}
+	})
+	reconnected := b.conn.Opts.ReconnectedCB
+	b.conn.SetReconnectHandler(func(nc *nats.Conn) {
+		b.notify(cache.Reconnected)
+		if reconnected != nil {
+			reconnected(nc)
+		}
+	})
+}
+
+// Implement cache.ConnectionNotifier
+func (b *NatsBroker) OnConnectionEvent(handler func(event cache.ConnectionEvent)) io.Closer {
+	b.handlersMu.Lock()
+	defer b.handlersMu.Unlock()
+	if b.handlers == nil {
+		b.handlers = make(map[uint64]func(event cache.ConnectionEvent))
+	}
+	id := b.nextHandler
+	b.nextHandler++
+	b.handlers[id] = handler
+	var cf closerFunc = func() error {
+		b.handlersMu.Lock()
+		defer b.handlersMu.Unlock()
+		delete(b.handlers, id)
+		return nil
+	}
+	return cf
+}
+
+func (b *NatsBroker) notify(event cache.ConnectionEvent) {
+	b.handlersMu.Lock()
+	handlers := make([]func(cache.ConnectionEvent), 0, len(b.handlers))
+	for _, h := range b.handlers {
+		handlers = append(handlers, h)
 	}
-	b.conn.Flush() // FIXME Maybe not ideal
-	return nil
+	b.handlersMu.Unlock()
+	for _, h := range handlers {
+		h(event)
+	}
+}
+
+// Implement Cache.MessageBroker. The message is buffered and flushed in
+// the background by the client, batches of keys are built by the cache.
+func (b *NatsBroker) Send(msg []byte) error {
+	return b.conn.Publish(b.topic, msg)
 }
 
 // Implement Cache.MessageBroker
@@ -0,0 +1,69 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package any_redis
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+
+	"sustainyfacts.dev/anycache/cache"
+)
+
+// Sends the invalidations of keys of the store to the groups, grouped by
+// group. Keys that are not entries of a configured group are ignored.
+func (a *adapter) invalidate(invalidator *cache.Invalidator, storeKeys []string) {
+	keys := make(map[string][]any)
+	a.groupsMu.RLock()
+	for _, storeKey := range storeKeys {
+		name, key, ok := strings.Cut(storeKey, ":")
+		if a.options.hashTags {
+			name = strings.TrimSuffix(strings.TrimPrefix(name, "{"), "}")
+		}
+		if _, configured := a.groupConfigs[name]; !ok || !configured {
+			continue // Not an entry of a group, like the tags
+		}
+		group, _, _ := strings.Cut(name, "@") // Without schema version
+		keys[group] = append(keys[group], key)
+	}
+	a.groupsMu.RUnlock()
+
+	for group, k := range keys {
+		if err := invalidator.Del(group, k...); err != nil {
+			log.Printf("Warn - cannot invalidate keys of group %s: %v", group, err)
+		}
+	}
+}
+
+// Invalidator delivering its messages to a subscription handler. Keys are
+// encoded as formatted in the store, and decoded by the groups.
+func newHandlerInvalidator(handler func(msg []byte)) *cache.Invalidator {
+	return cache.NewInvalidator(&handlerBroker{handler: handler}).WithCodec(cache.TextCodec)
+}
+
+type handlerBroker struct {
+	handler func(msg []byte)
+}
+
+func (b *handlerBroker) Send(msg []byte) error {
+	b.handler(msg)
+	return nil
+}
+
+func (b *handlerBroker) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	return nil, errors.New("cannot subscribe to the invalidations of a subscription")
+}
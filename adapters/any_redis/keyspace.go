@@ -0,0 +1,130 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package any_redis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"sustainyfacts.dev/anycache/cache"
+)
+
+type KeyspaceConfig struct {
+	// Events invalidating the entries of the groups
+	Events []string
+	// Enables the keyspace notifications of the events on the server (CONFIG SET
+	// notify-keyspace-events Kxge), which is often forbidden on managed services.
+	// Otherwise they must be enabled in the configuration of the server.
+	ConfigureServer bool
+}
+
+var DefaultKeyspaceConfig = KeyspaceConfig{Events: []string{"expired", "evicted", "del"}}
+
+// KeyspaceBroker is a cache.MessageBroker delivering the expiration, eviction
+// and deletion of the entries of the second level store as invalidations, so
+// that the entries of the first level do not outlive them. Only the keys of the
+// groups configured in the store are notified, and mapped back to the groups.
+//
+// Keys are decoded from their formatted value with cache.TextCodec. Send does
+// nothing: to also receive the messages of the groups, combine the broker with
+// another one using cache.NewBridgeBroker.
+type KeyspaceBroker struct {
+	store  *adapter
+	config KeyspaceConfig
+}
+
+var _ cache.MessageBroker = (*KeyspaceBroker)(nil)
+
+// Creates a broker notifying the events of the entries of a store of this package
+func NewKeyspaceBroker(store cache.Store, config KeyspaceConfig) (*KeyspaceBroker, error) {
+	if len(config.Events) == 0 {
+		config.Events = DefaultKeyspaceConfig.Events
+	}
+	a, ok := store.(interface{ base() *adapter })
+	if !ok {
+		return nil, fmt.Errorf("%T is not a Redis store", store)
+	}
+	b := &KeyspaceBroker{store: a.base(), config: config}
+	if _, ok := b.store.rdb.(*redis.ClusterClient); ok {
+		return nil, errors.New("keyspace notifications are not supported in a cluster, as each node notifies its own keys")
+	}
+	if config.ConfigureServer {
+		if err := b.store.rdb.ConfigSet(ctx, "notify-keyspace-events", "Kxge").Err(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Implement cache.MessageBroker. Events are notified by the server.
+func (b *KeyspaceBroker) Send(msg []byte) error {
+	return nil
+}
+
+// Implement cache.MessageBroker. Subscribes to the keyspace channels of the keys
+// of each group configured in the store, including the groups configured later,
+// whose messages are the events.
+func (b *KeyspaceBroker) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	db := 0
+	if c, ok := b.store.rdb.(*redis.Client); ok {
+		db = c.Options().DB
+	}
+	prefix := fmt.Sprintf("__keyspace@%d__:", db)
+	pattern := func(group string) string {
+		return prefix + escapePattern(b.store.groupTag(group)+":") + "*"
+	}
+
+	invalidator := newHandlerInvalidator(handler)
+	pubsub := b.store.rdb.PSubscribe(ctx)
+	groups := b.store.onConfigureGroup(func(group string) {
+		if err := pubsub.PSubscribe(ctx, pattern(group)); err != nil {
+			log.Printf("Warn - cannot subscribe to the keyspace of group %s: %v", group, err)
+		}
+	})
+	patterns := make([]string, len(groups.names))
+	for i, group := range groups.names {
+		patterns[i] = pattern(group)
+	}
+	if len(patterns) > 0 {
+		if err := pubsub.PSubscribe(ctx, patterns...); err != nil {
+			groups.Close()
+			pubsub.Close()
+			return nil, err
+		}
+	}
+	go func() {
+		for msg := range pubsub.Channel() {
+			if slices.Contains(b.config.Events, msg.Payload) {
+				b.store.invalidate(invalidator, []string{strings.TrimPrefix(msg.Channel, prefix)})
+			}
+		}
+	}()
+
+	var cf closerFunc = func() error {
+		groups.Close()
+		return pubsub.Close()
+	}
+	return cf, nil
+}
+
+func (a *adapter) base() *adapter {
+	return a
+}
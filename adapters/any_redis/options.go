@@ -0,0 +1,321 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package any_redis
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"sustainyfacts.dev/anycache/cache"
+)
+
+// Option configures an adapter
+type Option func(*options)
+
+type options struct {
+	hashTags      bool
+	shardedPubSub bool
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	// Of the clients created by the adapter
+	tls                *tls.Config
+	username, password string
+	poolSize, minIdle  int
+	maxIdleTime        time.Duration
+
+	healthInterval time.Duration
+
+	lazy       bool
+	retryDelay time.Duration
+}
+
+func newOptions(opts []Option) options {
+	var o options
+	for _, option := range opts {
+		option(&o)
+	}
+	return o
+}
+
+// WithHashTags puts the name of the group in a hash tag ({group}:key), so that all
+// the entries of a group are in the same slot of a cluster. Multi-key commands
+// are then sent at once, but a group cannot be spread over the shards.
+//
+// The keys change, so the entries stored without hash tag are not found anymore.
+func WithHashTags() Option {
+	return func(o *options) {
+		o.hashTags = true
+	}
+}
+
+// WithShardedPubSub sends the messages with SPUBLISH and SSUBSCRIBE (Redis 7),
+// so that in a cluster they are only propagated to the shard owning the topic
+func WithShardedPubSub() Option {
+	return func(o *options) {
+		o.shardedPubSub = true
+	}
+}
+
+// WithTimeouts limits the duration of each read (GET) and write (SET, DEL,
+// PUBLISH) command. Only applies to the clients created by the adapter, or
+// with ContextTimeoutEnabled set.
+func WithTimeouts(read time.Duration, write time.Duration) Option {
+	return func(o *options) {
+		o.readTimeout, o.writeTimeout = read, write
+	}
+}
+
+// WithTLS connects with TLS, with the given configuration
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tls = config
+	}
+}
+
+// WithCredentials authenticates with a user of the ACL (Redis 6), or with
+// the password only if the username is empty
+func WithCredentials(username string, password string) Option {
+	return func(o *options) {
+		o.username, o.password = username, password
+	}
+}
+
+// WithPool sets the maximum number of connections, the number of idle
+// connections kept open, and how long idle connections are kept
+func WithPool(size int, minIdle int, maxIdleTime time.Duration) Option {
+	return func(o *options) {
+		o.poolSize, o.minIdle, o.maxIdleTime = size, minIdle, maxIdleTime
+	}
+}
+
+// WithHealthCheck pings the server periodically. While it does not respond, the
+// adapter reports itself unhealthy (see cache.HealthChecker), and the groups do
+// not use it as second level store. The check is stopped by closing the adapter
+// (see io.Closer).
+func WithHealthCheck(interval time.Duration) Option {
+	return func(o *options) {
+		o.healthInterval = interval
+	}
+}
+
+// WithLazyConnect returns the adapter without waiting for the server, which is
+// reached in the background, retrying after the delay (doubled up to a minute).
+// Until then, the adapter misses all the entries, drops the writes and reports
+// itself unhealthy, so that the groups run on their first level store only.
+//
+// Once connected, Reconnected is reported to the groups (see
+// cache.ConnectionNotifier) if the first attempt failed: the groups with a
+// DisconnectPolicy other than WarnOnDisconnect clear their first level store,
+// as they may have missed invalidations.
+func WithLazyConnect(retryDelay time.Duration) Option {
+	return func(o *options) {
+		o.lazy, o.retryDelay = true, retryDelay
+	}
+}
+
+// Maximum delay between connection attempts
+const maxRetryDelay = time.Minute
+
+// Applies the options to the options of a new client
+func (o *options) apply(opts *redis.Options) {
+	if o.readTimeout > 0 || o.writeTimeout > 0 {
+		opts.ContextTimeoutEnabled = true
+	}
+	if o.tls != nil {
+		opts.TLSConfig = o.tls
+	}
+	if o.password != "" {
+		opts.Username, opts.Password = o.username, o.password
+	}
+	if o.poolSize > 0 {
+		opts.PoolSize = o.poolSize
+	}
+	if o.minIdle > 0 {
+		opts.MinIdleConns = o.minIdle
+	}
+	if o.maxIdleTime > 0 {
+		opts.ConnMaxIdleTime = o.maxIdleTime
+	}
+}
+
+func (o *options) applyUniversal(opts *redis.UniversalOptions) {
+	if o.readTimeout > 0 || o.writeTimeout > 0 {
+		opts.ContextTimeoutEnabled = true
+	}
+	if o.tls != nil {
+		opts.TLSConfig = o.tls
+	}
+	if o.password != "" {
+		opts.Username, opts.Password = o.username, o.password
+	}
+	if o.poolSize > 0 {
+		opts.PoolSize = o.poolSize
+	}
+	if o.minIdle > 0 {
+		opts.MinIdleConns = o.minIdle
+	}
+	if o.maxIdleTime > 0 {
+		opts.ConnMaxIdleTime = o.maxIdleTime
+	}
+}
+
+func (o *options) readContext() (context.Context, context.CancelFunc) {
+	return withTimeout(o.readTimeout)
+}
+
+func (o *options) writeContext() (context.Context, context.CancelFunc) {
+	return withTimeout(o.writeTimeout)
+}
+
+func withTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Implement cache.HealthChecker. Always healthy once connected, without health check.
+func (a *adapter) Healthy() bool {
+	return a.connected.Load() && !a.unhealthy.Load()
+}
+
+// Connects in the background, retrying until the server is reached
+func (a *adapter) connectLater() {
+	delay := a.options.retryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	failed := false
+	for {
+		err := ping(a.rdb, a.options)
+		if err == nil {
+			break
+		}
+		if !failed {
+			log.Printf("Warn - cannot connect to Redis, retrying in the background: %v", err)
+			failed = true
+		}
+		select {
+		case <-time.After(delay):
+		case <-a.stop:
+			return // Closed
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+	a.connected.Store(true)
+	if failed {
+		a.notify(cache.Reconnected)
+	}
+}
+
+// Pings the server periodically, and reports the changes of health
+func (a *adapter) checkHealth() {
+	ticker := time.NewTicker(a.options.healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.stop:
+			return // Closed
+		}
+		ctx, cancel := a.options.readContext()
+		err := a.rdb.Ping(ctx).Err()
+		cancel()
+		if unhealthy := err != nil; a.unhealthy.Swap(unhealthy) != unhealthy {
+			if unhealthy {
+				log.Printf("Warn - Redis is unhealthy: %v", err)
+			} else {
+				log.Printf("Redis is healthy again")
+			}
+		}
+	}
+}
+
+// Close stops the health check and the connection attempts, and closes the
+// client if it was created by the adapter
+func (a *adapter) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		close(a.stop)
+		if a.ownsClient {
+			err = a.rdb.Close()
+		}
+	})
+	return err
+}
+
+// Name of the group in the keys, in a hash tag if enabled
+func (a *adapter) groupTag(groupName string) string {
+	if a.options.hashTags {
+		return "{" + groupName + "}"
+	}
+	return groupName
+}
+
+// Unlinks the keys. In a cluster, keys are grouped by slot, as a command cannot
+// have keys of different slots, and the commands are pipelined.
+func (a *adapter) unlink(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if _, ok := a.rdb.(*redis.ClusterClient); !ok {
+		return a.rdb.Unlink(ctx, keys...).Err()
+	}
+	slots := make(map[uint16][]string)
+	for _, k := range keys {
+		slot := keySlot(k)
+		slots[slot] = append(slots[slot], k)
+	}
+	_, err := a.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, keys := range slots {
+			pipe.Unlink(ctx, keys...)
+		}
+		return nil
+	})
+	return err
+}
+
+// Slot of a key in a cluster: CRC16 of the key, or of its hash tag if any
+func keySlot(key string) uint16 {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return crc16(key) % 16384
+}
+
+// CRC16-CCITT (XMODEM), as used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -23,6 +23,8 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/redis/go-redis/v9"
 	"sustainyfacts.dev/anycache/cache"
@@ -33,38 +35,76 @@ var ctx = context.Background()
 // Creates a new adapter for Redis, and checks for its availability
 // using the PING command and retrieves the server version. Uses the provided
 // topic so it can be used for cluster communication (distributed cache flush)
-func NewAdapterWithMessaging(url string, topic string) (cache.BrokerStore, error) {
-	return newAdapter(url, topic)
+func NewAdapterWithMessaging(url string, topic string, options ...Option) (cache.BrokerStore, error) {
+	return newAdapter(url, topic, options)
 }
 
 // Creates a new adapter for Redis, and checks for its availability
 // using the PING command and retrieves the server version.
-func NewAdapter(url string) (cache.Store, error) {
-	return newAdapter(url, "")
+func NewAdapter(url string, options ...Option) (cache.Store, error) {
+	return newAdapter(url, "", options)
 }
 
-// Creates a new adapter for Redis with redis.Client given as parameter
-func NewAdapterWithClient(rdb *redis.Client, topic string) (cache.Store, error) {
-	return &adapter{rdb: rdb, groupConfigs: make(map[string]cache.GroupConfig), topic: topic}, nil
+// Creates a new adapter for Redis with redis.Client given as parameter. The
+// options configuring the client (TLS, credentials, pool) are ignored.
+func NewAdapterWithClient(rdb *redis.Client, topic string, options ...Option) (cache.Store, error) {
+	return newAdapterWithClient(rdb, topic, newOptions(options)), nil
 }
 
-func newAdapter(url string, topic string) (*adapter, error) {
+// Creates a new adapter for Redis with a redis.UniversalClient given as parameter:
+// a single node, a cluster or a failover client with Sentinel. The options
+// configuring the client (TLS, credentials, pool) are ignored.
+func NewUniversalAdapter(rdb redis.UniversalClient, topic string, options ...Option) (cache.BrokerStore, error) {
+	return newAdapterWithClient(rdb, topic, newOptions(options)), nil
+}
+
+// Creates a new adapter for Redis with the client created from the options: a
+// cluster client if several addresses are given, a failover client with Sentinel
+// if the master name is given, a single node client otherwise. Checks for its
+// availability using the PING command and retrieves the server version.
+func NewUniversalAdapterWithOptions(opts *redis.UniversalOptions, topic string, options ...Option) (cache.BrokerStore, error) {
+	o := newOptions(options)
+	universal := *opts
+	o.applyUniversal(&universal)
+	return connect(redis.NewUniversalClient(&universal), topic, o)
+}
+
+func newAdapter(url string, topic string, options []Option) (*adapter, error) {
 	opts, err := redis.ParseURL(url)
 	if err != nil {
 		return nil, err
 	}
-	rdb := redis.NewClient(opts)
+	o := newOptions(options)
+	o.apply(opts)
+	return connect(redis.NewClient(opts), topic, o)
+}
+
+// Checks the availability of the server, unless connecting lazily
+func connect(rdb redis.UniversalClient, topic string, o options) (*adapter, error) {
+	if !o.lazy {
+		if err := ping(rdb, o); err != nil {
+			return nil, err
+		}
+	}
+	a := newAdapterWithClient(rdb, topic, o)
+	a.ownsClient = true
+	return a, nil
+}
 
+// Checks the availability of the server, and logs its version
+func ping(rdb redis.UniversalClient, o options) error {
+	ctx, cancel := o.readContext()
+	defer cancel()
 	pong, err := rdb.Ping(ctx).Result()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if pong != "PONG" {
-		return nil, fmt.Errorf("invalid ping response: %s", pong)
+		return fmt.Errorf("invalid ping response: %s", pong)
 	}
 	info, err := rdb.Info(ctx, "server").Result()
 	if err != nil {
-		return nil, err
+		return err
 	}
 	serverVersion := "unkown"
 	for _, line := range strings.Split(info, "\n") {
@@ -73,24 +113,107 @@ func newAdapter(url string, topic string) (*adapter, error) {
 		}
 	}
 	log.Printf("Connected to Redis: %s", serverVersion)
-	return &adapter{rdb: rdb, groupConfigs: make(map[string]cache.GroupConfig), topic: topic}, nil
+	return nil
+}
+
+func newAdapterWithClient(rdb redis.UniversalClient, topic string, o options) *adapter {
+	a := &adapter{rdb: rdb, groupConfigs: make(map[string]cache.GroupConfig), topic: topic, options: o,
+		stop: make(chan struct{}), connecting: make(chan struct{})}
+	if o.lazy {
+		go func() {
+			defer close(a.connecting)
+			a.connectLater()
+		}()
+	} else {
+		a.connected.Store(true)
+		close(a.connecting)
+	}
+	if o.healthInterval > 0 {
+		go a.checkHealth()
+	}
+	return a
 }
 
 type adapter struct {
-	rdb          *redis.Client
+	rdb          redis.UniversalClient
 	topic        string // For messaging
+	options      options
+	groupsMu     sync.RWMutex
 	groupConfigs map[string]cache.GroupConfig
+	// Notified of the groups configured, by id
+	groupListeners    map[uint64]func(name string)
+	nextGroupListener uint64
+
+	connected atomic.Bool // Once the server has been reached, with lazy connect
+	unhealthy atomic.Bool // Set by the health check
+
+	ownsClient bool          // Client created by the adapter, closed with it
+	stop       chan struct{} // Closed by Close, stops the background goroutines
+	connecting chan struct{} // Closed once the connection attempts end
+	closeOnce  sync.Once
+
+	handlersMu  sync.Mutex
+	handlers    map[uint64]func(event cache.ConnectionEvent) // Connection events handlers, by id
+	nextHandler uint64
 }
 
 func (a *adapter) ConfigureGroup(name string, config cache.GroupConfig) {
 	if config.Cost != 0 {
 		panic("Redis does not support Cost")
 	}
+	a.groupsMu.Lock()
 	a.groupConfigs[name] = config
+	listeners := make([]func(name string), 0, len(a.groupListeners))
+	for _, l := range a.groupListeners {
+		listeners = append(listeners, l)
+	}
+	a.groupsMu.Unlock()
+	for _, l := range listeners {
+		l(name)
+	}
 }
 
-func (a *adapter) Get(key cache.GroupKey) (any, error) {
+// Groups configured so far, and registration of a listener of the groups
+// configured later
+type configuredGroups struct {
+	names []string
+	io.Closer
+}
+
+func (a *adapter) onConfigureGroup(listener func(name string)) configuredGroups {
+	a.groupsMu.Lock()
+	defer a.groupsMu.Unlock()
+	names := make([]string, 0, len(a.groupConfigs))
+	for name := range a.groupConfigs {
+		names = append(names, name)
+	}
+	if a.groupListeners == nil {
+		a.groupListeners = make(map[uint64]func(name string))
+	}
+	id := a.nextGroupListener
+	a.nextGroupListener++
+	a.groupListeners[id] = listener
+	var cf closerFunc = func() error {
+		a.groupsMu.Lock()
+		defer a.groupsMu.Unlock()
+		delete(a.groupListeners, id)
+		return nil
+	}
+	return configuredGroups{names: names, Closer: cf}
+}
 
+func (a *adapter) groupConfig(name string) cache.GroupConfig {
+	a.groupsMu.RLock()
+	defer a.groupsMu.RUnlock()
+	return a.groupConfigs[name]
+}
+
+func (a *adapter) Get(key cache.GroupKey) (any, error) {
+	if !a.connected.Load() {
+		return nil, cache.ErrKeyNotFound
+	}
+	ctx, cancel := a.options.readContext()
+	defer cancel()
 	v, err := a.rdb.Get(ctx, key.StoreKey.(string)).Result()
 	if err == redis.Nil {
 		return nil, cache.ErrKeyNotFound
@@ -98,7 +221,7 @@ func (a *adapter) Get(key cache.GroupKey) (any, error) {
 		return nil, err
 	}
 
-	expectedType := a.groupConfigs[key.GroupName].ValueType
+	expectedType := a.groupConfig(key.GroupName).ValueType
 	switch expectedType.Kind() {
 	case reflect.Int:
 		i, err := strconv.Atoi(v)
@@ -133,19 +256,125 @@ func (a *adapter) Get(key cache.GroupKey) (any, error) {
 
 // new test
 func (a *adapter) Set(key cache.GroupKey, value any) error {
-	ttl := a.groupConfigs[key.GroupName].Ttl
+	if !a.connected.Load() {
+		return nil // Dropped
+	}
+	ttl := a.groupConfig(key.GroupName).Ttl
+	ctx, cancel := a.options.writeContext()
+	defer cancel()
 	return a.rdb.Set(ctx, key.StoreKey.(string), value, ttl).Err()
 }
 
 func (a *adapter) Del(key cache.GroupKey) error {
+	if !a.connected.Load() {
+		return nil
+	}
+	ctx, cancel := a.options.writeContext()
+	defer cancel()
 	return a.rdb.Del(ctx, key.StoreKey.(string)).Err()
 }
 
 func (a *adapter) Key(groupName string, key any) cache.GroupKey {
-	adapterKey := fmt.Sprintf("%s:%v", groupName, key)
+	adapterKey := fmt.Sprintf("%s:%v", a.groupTag(groupName), key)
 	return cache.GroupKey{GroupName: groupName, StoreKey: adapterKey}
 }
 
+// Implement cache.PrefixStore. Scans the keys of the group starting with
+// the prefix and unlinks them by batches, on each master of a cluster.
+func (a *adapter) DelPrefix(groupName string, prefix string) error {
+	if !a.connected.Load() {
+		return nil
+	}
+	pattern := escapePattern(a.Key(groupName, prefix).StoreKey.(string)) + "*"
+	if cluster, ok := a.rdb.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return a.delPattern(master, pattern)
+		})
+	}
+	return a.delPattern(a.rdb, pattern)
+}
+
+func (a *adapter) delPattern(rdb redis.UniversalClient, pattern string) error {
+	iter := rdb.Scan(ctx, 0, pattern, scanCount).Iterator()
+	keys := make([]string, 0, scanCount)
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == scanCount {
+			if err := a.unlink(keys...); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return a.unlink(keys...)
+}
+
+// Implement cache.Clearer
+func (a *adapter) Clear(groupName string) {
+	if err := a.DelPrefix(groupName, ""); err != nil {
+		log.Printf("Warn - cannot clear group %s: %v", groupName, err)
+	}
+}
+
+// Number of keys per SCAN and UNLINK call
+const scanCount = 1000
+
+// Escapes the special characters of a glob-style pattern
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Implement cache.TagStore. The keys of the entries carrying a tag are kept in a set
+func (a *adapter) SetTags(key cache.GroupKey, tags []string) error {
+	if !a.connected.Load() {
+		return nil
+	}
+	ttl := a.groupConfig(key.GroupName).Ttl
+	ctx, cancel := a.options.writeContext()
+	defer cancel()
+	_, err := a.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, tag := range tags {
+			tk := a.tagKey(key.GroupName, tag)
+			pipe.SAdd(ctx, tk, key.StoreKey)
+			if ttl != 0 { // The set lives as long as the last entry added
+				pipe.Expire(ctx, tk, ttl)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Implement cache.TagStore
+func (a *adapter) DelTag(groupName string, tag string) error {
+	if !a.connected.Load() {
+		return nil
+	}
+	tk := a.tagKey(groupName, tag)
+	ctx, cancel := a.options.readContext()
+	defer cancel()
+	keys, err := a.rdb.SMembers(ctx, tk).Result()
+	if err != nil {
+		return err
+	}
+	return a.unlink(append(keys, tk)...)
+}
+
+func (a *adapter) tagKey(groupName string, tag string) string {
+	return fmt.Sprintf("%s#tag:%s", a.groupTag(groupName), tag)
+}
+
 // Send a message to all other caches
 
 // Subcribe to messages from another caches
@@ -155,6 +384,11 @@ func (a *adapter) Send(msg []byte) error {
 	if a.topic == "" {
 		panic("messing not configured")
 	}
+	ctx, cancel := a.options.writeContext()
+	defer cancel()
+	if a.options.shardedPubSub {
+		return a.rdb.SPublish(ctx, a.topic, msg).Err()
+	}
 	return a.rdb.Publish(ctx, a.topic, msg).Err()
 }
 
@@ -163,14 +397,29 @@ func (a *adapter) Subscribe(handler func(msg []byte)) (io.Closer, error) {
 	if a.topic == "" {
 		panic("messing not configured")
 	}
-	pubsub := a.rdb.Subscribe(ctx, a.topic)
+	var pubsub *redis.PubSub
+	if a.options.shardedPubSub {
+		pubsub = a.rdb.SSubscribe(ctx, a.topic)
+	} else {
+		pubsub = a.rdb.Subscribe(ctx, a.topic)
+	}
 
 	// Start processing
 	go func() {
-		ch := pubsub.Channel()
+		ch := pubsub.ChannelWithSubscriptions()
 
+		subscribed := false
 		for msg := range ch {
-			handler([]byte(msg.Payload))
+			switch msg := msg.(type) {
+			case *redis.Message:
+				handler([]byte(msg.Payload))
+			case *redis.Subscription:
+				// Subscriptions are renewed by the client after reconnecting
+				if subscribed {
+					a.notify(cache.Reconnected)
+				}
+				subscribed = true
+			}
 		}
 	}()
 
@@ -178,6 +427,38 @@ func (a *adapter) Subscribe(handler func(msg []byte)) (io.Closer, error) {
 	return cf, nil
 }
 
+// Implement cache.ConnectionNotifier. Only reconnections of the subscriptions are
+// reported, the client does not report lost connections.
+func (a *adapter) OnConnectionEvent(handler func(event cache.ConnectionEvent)) io.Closer {
+	a.handlersMu.Lock()
+	defer a.handlersMu.Unlock()
+	if a.handlers == nil {
+		a.handlers = make(map[uint64]func(event cache.ConnectionEvent))
+	}
+	id := a.nextHandler
+	a.nextHandler++
+	a.handlers[id] = handler
+	var cf closerFunc = func() error {
+		a.handlersMu.Lock()
+		defer a.handlersMu.Unlock()
+		delete(a.handlers, id)
+		return nil
+	}
+	return cf
+}
+
+func (a *adapter) notify(event cache.ConnectionEvent) {
+	a.handlersMu.Lock()
+	handlers := make([]func(cache.ConnectionEvent), 0, len(a.handlers))
+	for _, h := range a.handlers {
+		handlers = append(handlers, h)
+	}
+	a.handlersMu.Unlock()
+	for _, h := range handlers {
+		h(event)
+	}
+}
+
 // To be able to return an anonymous function in Subscribe()
 type closerFunc func() error
 
@@ -16,11 +16,16 @@ limitations under the License.
 package any_redis
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/redis/go-redis/v9"
 	"sustainyfacts.dev/anycache/cache"
 )
 
@@ -309,3 +314,204 @@ func TestDistributedFlush(t *testing.T) {
 		t.Errorf("group2 key lookup after flush should still be 2, but got %v", v)
 	}
 }
+
+func TestInvalidateTag(t *testing.T) {
+	redisStore, err := NewAdapter("redis://localhost:6379/0?protocol=3")
+	if err != nil {
+		panic(err)
+	}
+	counter := 0
+	loader := func(key string) (string, []string, error) {
+		counter++
+		return fmt.Sprintf("value %d", counter), []string{"tag-" + key}, nil
+	}
+	group := cache.NewTaggedFactory("TestInvalidateTag", loader).WithStore(cache.NewHashMapStore()).
+		WithSecondLevelStore(redisStore).Cache()
+
+	group.Get("key")
+	time.Sleep(10 * time.Millisecond) // Wait to make sure the second level cache is set (async)
+
+	cache.InvalidateTag("tag-key")
+	if _, err := redisStore.Get(redisStore.Key("TestInvalidateTag", "key")); err != cache.ErrKeyNotFound {
+		t.Errorf("key should have been deleted from redis, got %v", err)
+	}
+}
+
+func TestDelPrefix(t *testing.T) {
+	redisStore, err := NewAdapter("redis://localhost:6379/0?protocol=3")
+	if err != nil {
+		panic(err)
+	}
+	store := redisStore.(cache.PrefixStore)
+	redisStore.ConfigureGroup("TestDelPrefix", cache.GroupConfig{Ttl: testTTL, ValueType: reflect.TypeOf("")})
+	redisStore.Set(redisStore.Key("TestDelPrefix", "tenant:42:a"), "a")
+	redisStore.Set(redisStore.Key("TestDelPrefix", "tenant:43:a"), "a")
+
+	if err := store.DelPrefix("TestDelPrefix", "tenant:42:"); err != nil {
+		t.Error(err)
+	}
+	if _, err := redisStore.Get(redisStore.Key("TestDelPrefix", "tenant:42:a")); err != cache.ErrKeyNotFound {
+		t.Errorf("key with the prefix should have been deleted, got %v", err)
+	}
+	if v, _ := redisStore.Get(redisStore.Key("TestDelPrefix", "tenant:43:a")); v != "a" {
+		t.Errorf("key without the prefix should not have been deleted, got %v", v)
+	}
+}
+
+func TestTracking(t *testing.T) {
+	tracking, err := NewTrackingAdapter("redis://localhost:6379/0?protocol=3", DefaultTrackingConfig)
+	if err != nil {
+		panic(err)
+	}
+	redisStore, err := NewAdapter("redis://localhost:6379/0?protocol=3")
+	if err != nil {
+		panic(err)
+	}
+	loader := func(key int) (string, error) {
+		return fmt.Sprintf("value for %d", key), nil
+	}
+	group := cache.NewFactory("TestTracking", loader).WithStore(cache.NewHashMapStore()).
+		WithSecondLevelStore(tracking).WithBroker(tracking).WithTTL(testTTL).Cache()
+	time.Sleep(10 * time.Millisecond) // Wait for the subscription, connections are tracked once subscribed
+
+	if v, _ := group.Get(42); v != "value for 42" {
+		t.Errorf("value for 42 should be loaded, got %v", v)
+	}
+	time.Sleep(10 * time.Millisecond) // Wait for the second level (async)
+
+	// Changed by another node, without message
+	redisStore.ConfigureGroup("TestTracking", cache.GroupConfig{Ttl: testTTL, ValueType: reflect.TypeOf("")})
+	redisStore.Set(redisStore.Key("TestTracking", 42), "changed")
+	time.Sleep(10 * time.Millisecond) // Wait for the invalidation
+
+	if v, _ := group.Get(42); v != "changed" {
+		t.Errorf("value should have been invalidated by Redis, got %v", v)
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31c3 {
+		t.Errorf("crc16 should be 0x31c3, got %#x", crc)
+	}
+	if slot := keySlot("foo"); slot != 12182 {
+		t.Errorf("slot of foo should be 12182, got %d", slot)
+	}
+	if keySlot("{group}:key1") != keySlot("{group}#tag:tag") {
+		t.Errorf("keys with the same hash tag should be in the same slot")
+	}
+	if keySlot("{}:key") != crc16("{}:key")%16384 {
+		t.Errorf("empty hash tag should be ignored")
+	}
+}
+
+func TestStreamBroker(t *testing.T) {
+	opts, _ := redis.ParseURL("redis://localhost:6379/0?protocol=3")
+	rdb := redis.NewClient(opts)
+	config := DefaultStreamConfig
+	config.Stream = "TestStreamBroker"
+	config.Node = "node-1"
+	config.Block = 100 * time.Millisecond
+	rdb.Del(context.Background(), config.Stream, config.Stream+":nodes")
+	broker := NewStreamBroker(rdb, config)
+
+	var mu sync.Mutex
+	var received []string
+	handler := func(msg []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, string(msg))
+	}
+	closer, err := broker.Subscribe(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Send([]byte("1"))
+	time.Sleep(200 * time.Millisecond)
+	closer.Close()
+
+	// Sent while the node is stopped
+	broker.Send([]byte("2"))
+	closer, err = broker.Subscribe(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(received, []string{"1", "2"}) {
+		t.Errorf("messages missed while stopped should be received, got %v", received)
+	}
+}
+
+func TestKeyspaceBroker(t *testing.T) {
+	redisStore, err := NewAdapter("redis://localhost:6379/0?protocol=3")
+	if err != nil {
+		panic(err)
+	}
+	broker, err := NewKeyspaceBroker(redisStore, KeyspaceConfig{ConfigureServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := 0
+	loader := func(key int) (int, error) {
+		counter++
+		return counter, nil
+	}
+	group := cache.NewFactory("TestKeyspaceBroker", loader).WithStore(cache.NewHashMapStore()).
+		WithSecondLevelStore(redisStore).WithBroker(broker).WithTTL(testTTL).Cache()
+
+	group.Get(42)
+	time.Sleep(10 * time.Millisecond) // Wait for the second level (async)
+
+	// Deleted from Redis only, the first level is invalidated by the notification
+	redisStore.Del(redisStore.Key("TestKeyspaceBroker", 42))
+	time.Sleep(10 * time.Millisecond)
+
+	if v, _ := group.Get(42); v != 2 {
+		t.Errorf("entry should have been reloaded after its deletion from redis, got %v", v)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1}) // Nothing listening
+	store, _ := NewUniversalAdapter(rdb, "", WithHealthCheck(10*time.Millisecond), WithTimeouts(50*time.Millisecond, 50*time.Millisecond))
+	if !store.(cache.HealthChecker).Healthy() {
+		t.Errorf("store should be healthy before the first check")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if store.(cache.HealthChecker).Healthy() {
+		t.Errorf("store should be unhealthy when redis is unreachable")
+	}
+	if err := store.(io.Closer).Close(); err != nil {
+		t.Errorf("store should be closed, got %v", err)
+	}
+	if err := rdb.Ping(ctx).Err(); errors.Is(err, redis.ErrClosed) {
+		t.Errorf("client given to the adapter should not be closed")
+	}
+}
+
+func TestLazyConnect(t *testing.T) {
+	store, err := NewAdapter("redis://127.0.0.1:1/0", WithLazyConnect(10*time.Millisecond)) // Nothing listening
+	if err != nil {
+		t.Fatalf("lazy adapter should be created while redis is unreachable, got %v", err)
+	}
+	store.ConfigureGroup("TestLazyConnect", cache.GroupConfig{ValueType: reflect.TypeOf("")})
+	key := store.Key("TestLazyConnect", "key")
+	if err := store.Set(key, "value"); err != nil {
+		t.Errorf("writes should be dropped until connected, got %v", err)
+	}
+	if _, err := store.Get(key); err != cache.ErrKeyNotFound {
+		t.Errorf("entries should be missed until connected, got %v", err)
+	}
+	if store.(cache.HealthChecker).Healthy() {
+		t.Errorf("store should be unhealthy until connected")
+	}
+	store.(io.Closer).Close()
+	select {
+	case <-store.(*adapter).connecting:
+	case <-time.After(time.Second):
+		t.Errorf("connection attempts should stop once closed")
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package any_redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"sustainyfacts.dev/anycache/cache"
+)
+
+type StreamConfig struct {
+	Stream string // Key of the stream
+
+	// Retention of the messages: those older than Retention are trimmed if set
+	// (Redis 6.2), otherwise the stream is trimmed to about MaxLen messages
+	MaxLen    int64
+	Retention time.Duration
+
+	// Name of the node, which must be unique in the cluster. The last message
+	// received by the node is kept in Redis, so that a node that restarts
+	// receives the messages it missed. Without name, a node receives the
+	// messages sent after its subscription only.
+	Node string
+
+	// Messages sent during that period before the subscription are replayed.
+	// Only if the node has no last message yet.
+	ReplayFrom time.Duration
+
+	Count      int64         // Maximum number of messages read at once
+	Block      time.Duration // Maximum duration of a read waiting for messages
+	RetryDelay time.Duration // Between reads, after an error
+}
+
+var DefaultStreamConfig = StreamConfig{
+	Stream:     "anycache:messages",
+	MaxLen:     100_000,
+	Count:      100,
+	Block:      5 * time.Second,
+	RetryDelay: time.Second,
+}
+
+// StreamBroker is a cache.MessageBroker adding the messages to a Redis stream,
+// from which each node reads from the last message it received. Messages sent
+// while a node was disconnected are not lost, as long as they are not trimmed.
+type StreamBroker struct {
+	rdb    redis.UniversalClient
+	config StreamConfig
+
+	handlersMu  sync.Mutex
+	handlers    map[uint64]func(event cache.ConnectionEvent) // Connection events handlers, by id
+	nextHandler uint64
+}
+
+var (
+	_ cache.MessageBroker      = (*StreamBroker)(nil)
+	_ cache.ConnectionNotifier = (*StreamBroker)(nil)
+)
+
+// Creates a broker on a Redis stream, with the client given as parameter
+func NewStreamBroker(rdb redis.UniversalClient, config StreamConfig) *StreamBroker {
+	if config.Stream == "" {
+		config.Stream = DefaultStreamConfig.Stream
+	}
+	if config.MaxLen <= 0 {
+		config.MaxLen = DefaultStreamConfig.MaxLen
+	}
+	if config.Count <= 0 {
+		config.Count = DefaultStreamConfig.Count
+	}
+	if config.Block <= 0 {
+		config.Block = DefaultStreamConfig.Block
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = DefaultStreamConfig.RetryDelay
+	}
+	return &StreamBroker{rdb: rdb, config: config}
+}
+
+// Implement cache.MessageBroker. The stream is trimmed approximately, which is
+// cheaper than exactly.
+func (b *StreamBroker) Send(msg []byte) error {
+	args := &redis.XAddArgs{Stream: b.config.Stream, Approx: true, Values: []any{"msg", msg}}
+	if b.config.Retention > 0 {
+		args.MinID = streamID(time.Now().Add(-b.config.Retention))
+	} else {
+		args.MaxLen = b.config.MaxLen
+	}
+	return b.rdb.XAdd(ctx, args).Err()
+}
+
+// Implement cache.MessageBroker. With a node name, the broker must be subscribed
+// only once, as the subscriptions share the last message received.
+func (b *StreamBroker) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	lastID, err := b.lastID()
+	if err != nil {
+		return nil, err
+	}
+	subCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.read(subCtx, lastID, handler)
+	}()
+	var cf closerFunc = func() error {
+		cancel()
+		<-done
+		return nil
+	}
+	return cf, nil
+}
+
+// Reads the messages after the last ID until cancelled, and retries after errors
+func (b *StreamBroker) read(ctx context.Context, lastID string, handler func(msg []byte)) {
+	connected := true
+	for ctx.Err() == nil {
+		streams, err := b.rdb.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{b.config.Stream, lastID},
+			Count:   b.config.Count,
+			Block:   b.config.Block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue // No message during Block
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if connected {
+				log.Printf("Warn - cannot read stream %s: %v", b.config.Stream, err)
+				b.notify(cache.Disconnected)
+				connected = false
+			}
+			select {
+			case <-time.After(b.config.RetryDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		if !connected {
+			b.notify(cache.Reconnected)
+			connected = true
+		}
+
+		for _, stream := range streams {
+			for _, m := range stream.Messages {
+				lastID = m.ID
+				if msg, ok := m.Values["msg"].(string); ok {
+					handler([]byte(msg))
+				}
+			}
+		}
+		if b.config.Node != "" {
+			if err := b.rdb.HSet(ctx, b.nodesKey(), b.config.Node, lastID).Err(); err != nil {
+				log.Printf("Warn - cannot save last message of node %s: %v", b.config.Node, err)
+			}
+		}
+	}
+}
+
+// ID from which the subscription reads (excluded)
+func (b *StreamBroker) lastID() (string, error) {
+	if b.config.Node != "" {
+		id, err := b.rdb.HGet(ctx, b.nodesKey(), b.config.Node).Result()
+		if err == nil {
+			return id, nil
+		} else if !errors.Is(err, redis.Nil) {
+			return "", err
+		}
+	}
+	return streamID(time.Now().Add(-b.config.ReplayFrom)), nil
+}
+
+// Hash keeping the last message received by each node
+func (b *StreamBroker) nodesKey() string {
+	return b.config.Stream + ":nodes"
+}
+
+// Implement cache.ConnectionNotifier
+func (b *StreamBroker) OnConnectionEvent(handler func(event cache.ConnectionEvent)) io.Closer {
+	b.handlersMu.Lock()
+	defer b.handlersMu.Unlock()
+	if b.handlers == nil {
+		b.handlers = make(map[uint64]func(event cache.ConnectionEvent))
+	}
+	id := b.nextHandler
+	b.nextHandler++
+	b.handlers[id] = handler
+	var cf closerFunc = func() error {
+		b.handlersMu.Lock()
+		defer b.handlersMu.Unlock()
+		delete(b.handlers, id)
+		return nil
+	}
+	return cf
+}
+
+func (b *StreamBroker) notify(event cache.ConnectionEvent) {
+	b.handlersMu.Lock()
+	handlers := make([]func(cache.ConnectionEvent), 0, len(b.handlers))
+	for _, h := range b.handlers {
+		handlers = append(handlers, h)
+	}
+	b.handlersMu.Unlock()
+	for _, h := range handlers {
+		h(event)
+	}
+}
+
+// ID of the messages added at that time
+func streamID(t time.Time) string {
+	return fmt.Sprintf("%d-0", t.UnixMilli())
+}
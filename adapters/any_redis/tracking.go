@@ -0,0 +1,200 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package any_redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+	"sustainyfacts.dev/anycache/cache"
+)
+
+// Channel of the invalidations redirected by the server
+const invalidateChannel = "__redis__:invalidate"
+
+type TrackingConfig struct {
+	// In broadcast mode, the node is notified of the changes of all the keys of
+	// the groups, instead of only the keys it has read
+	Broadcast bool
+	// Groups tracked in broadcast mode, with their schema version if any (as
+	// named in the store). All the keys are tracked if empty.
+	Groups []string
+	// The changes made by a connection are not notified to itself
+	NoLoop bool
+}
+
+var DefaultTrackingConfig = TrackingConfig{NoLoop: true}
+
+// Creates a new adapter for Redis using the server-assisted client side caching:
+// the server tracks the keys read by the node (or the keys of the groups in
+// broadcast mode) and notifies their changes, which the adapter delivers as
+// invalidations to the subscribed groups. No message is published, Send does
+// nothing: the groups must use the adapter as second level store, so that their
+// changes are made in Redis.
+//
+// Invalidations are redirected to a subscription, so the data connections use
+// the RESP2 protocol. Flushes of the database are not notified.
+func NewTrackingAdapter(url string, config TrackingConfig, options ...Option) (cache.BrokerStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	o := newOptions(options)
+	o.apply(opts)
+	b := make([]byte, 8)
+	rand.Read(b)
+	t := &trackingAdapter{config: config, name: "anycache-" + hex.EncodeToString(b)}
+
+	listenerOpts := *opts
+	listenerOpts.Protocol = 2 // Invalidations are received as messages of the channel
+	listenerOpts.ClientName = t.name + "-invalidations"
+	t.listener = redis.NewClient(&listenerOpts)
+
+	opts.Protocol = 2 // Pushes would be received with the replies
+	opts.ClientName = t.name
+	opts.OnConnect = t.track
+	if t.adapter, err = connect(redis.NewClient(opts), "", o); err != nil {
+		t.listener.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+type trackingAdapter struct {
+	*adapter
+	config   TrackingConfig
+	name     string        // Client name of the data connections
+	listener *redis.Client // Client of the subscription receiving the invalidations
+	redirect atomic.Int64  // Client ID of the subscription
+}
+
+// Implement cache.Broker. Changes are notified by the server.
+func (t *trackingAdapter) Send(msg []byte) error {
+	return nil
+}
+
+// Implement cache.Broker. The adapter must be subscribed only once, as the
+// invalidations are redirected to a single subscription.
+func (t *trackingAdapter) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	invalidator := newHandlerInvalidator(handler)
+	pubsub := t.listener.Subscribe(ctx, invalidateChannel)
+	go func() {
+		subscribed := false
+		for msg := range pubsub.ChannelWithSubscriptions() {
+			switch msg := msg.(type) {
+			case *redis.Message:
+				t.invalidate(invalidator, msg.PayloadSlice)
+			case *redis.Subscription:
+				// The connections must redirect to the new subscription
+				if err := t.retrack(); err != nil {
+					log.Printf("Warn - cannot enable Redis tracking: %v", err)
+				}
+				if subscribed {
+					t.notify(cache.Reconnected)
+				}
+				subscribed = true
+			}
+		}
+	}()
+
+	var cf closerFunc = pubsub.Close
+	return cf, nil
+}
+
+// Close closes the subscription client as well
+func (t *trackingAdapter) Close() error {
+	return errors.Join(t.adapter.Close(), t.listener.Close())
+}
+
+// Enables the tracking on a new data connection
+func (t *trackingAdapter) track(ctx context.Context, cn *redis.Conn) error {
+	redirect := t.redirect.Load()
+	if redirect == 0 {
+		return nil // Not subscribed yet, enabled once subscribed
+	}
+	args := []any{"CLIENT", "TRACKING", "ON", "REDIRECT", redirect}
+	if t.config.Broadcast {
+		args = append(args, "BCAST")
+		for _, g := range t.config.Groups {
+			args = append(args, "PREFIX", t.groupTag(g)+":")
+		}
+	}
+	if t.config.NoLoop {
+		args = append(args, "NOLOOP")
+	}
+	if err := cn.Process(ctx, redis.NewCmd(ctx, args...)); err != nil {
+		log.Printf("Warn - cannot enable Redis tracking: %v", err) // The connection stays usable
+	}
+	return nil
+}
+
+// Redirects the tracking to the current subscription: the data connections are
+// closed, and reconnect with the tracking enabled.
+func (t *trackingAdapter) retrack() error {
+	ids, err := t.clientIDs("pubsub", t.listener.Options().ClientName)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return errors.New("subscription not found")
+	}
+	t.redirect.Store(ids[0])
+
+	if ids, err = t.clientIDs("normal", t.name); err != nil {
+		return err
+	}
+	_, err = t.listener.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.ClientKillByFilter(ctx, "ID", strconv.FormatInt(id, 10))
+		}
+		return nil
+	})
+	return err
+}
+
+// IDs of the connections of a type with a name
+func (t *trackingAdapter) clientIDs(clientType string, name string) ([]int64, error) {
+	list, err := t.listener.Do(ctx, "CLIENT", "LIST", "TYPE", clientType).Text()
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, line := range strings.Split(list, "\n") {
+		fields := make(map[string]string)
+		for _, field := range strings.Fields(line) {
+			if k, v, ok := strings.Cut(field, "="); ok {
+				fields[k] = v
+			}
+		}
+		if fields["name"] == name {
+			id, err := strconv.ParseInt(fields["id"], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client list: %w", err)
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
@@ -22,7 +22,10 @@ import (
 	"time"
 )
 
-var ErrKeyNotFound = errors.New("key not found")
+var (
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrNotSupported = errors.New("operation not supported")
+)
 
 type GroupKey struct {
 	GroupName string
@@ -51,6 +54,33 @@ type Store interface {
 	Key(groupName string, key any) GroupKey
 }
 
+// Clearer is implemented by stores that can delete all the entries of a group
+type Clearer interface {
+	Clear(groupName string)
+}
+
+// PrefixStore is implemented by stores that can delete all the entries of
+// a group whose key starts with a prefix. Only used for groups with string keys.
+type PrefixStore interface {
+	DelPrefix(groupName string, prefix string) error
+}
+
+// TagStore is implemented by stores that can keep the tags of their entries,
+// so that the entries carrying a tag can be deleted from any node
+type TagStore interface {
+	// Associates the tags with an entry
+	SetTags(key GroupKey, tags []string) error
+	// Deletes all the entries of the group carrying the tag
+	DelTag(groupName string, tag string) error
+}
+
+// HealthChecker is implemented by stores that know whether their server is
+// reachable. Groups do not read nor fill an unhealthy second level store, and
+// load the entries instead of waiting for its errors. Entries are still deleted.
+type HealthChecker interface {
+	Healthy() bool
+}
+
 // MessageBroker is an interface that can be used to provide clustered communication
 // to the cache, for sending and receiving Flush messages
 type MessageBroker interface {
@@ -60,6 +90,22 @@ type MessageBroker interface {
 	Subscribe(func(msg []byte)) (io.Closer, error)
 }
 
+// ConnectionEvent is reported by the brokers implementing ConnectionNotifier
+type ConnectionEvent int
+
+const (
+	Disconnected ConnectionEvent = iota + 1 // Messages may be lost until reconnected
+	Reconnected                             // Messages sent while disconnected may have been lost
+)
+
+// ConnectionNotifier is implemented by brokers that can report the state of their
+// connection, so that the groups know when they may have missed messages
+type ConnectionNotifier interface {
+	// Registers a function called when the connection is lost or restored, until
+	// the returned closer is closed
+	OnConnectionEvent(handler func(event ConnectionEvent)) io.Closer
+}
+
 // Some brokers are as well message store
 type BrokerStore interface {
 	MessageBroker
@@ -0,0 +1,300 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+var ErrUnsupportedKey = errors.New("key type not supported by codec")
+
+// BinaryCodec encodes the messages in a compact binary format, with varints
+// and length-prefixed strings. Fields added by later versions are appended,
+// and ignored by the previous versions.
+//
+// Keys can be strings, booleans, numbers, arrays and structs of those, or
+// implement encoding.BinaryMarshaler or encoding.TextMarshaler (and the
+// matching unmarshaler on their pointer). All the fields of structs must
+// be exported.
+var BinaryCodec MessageCodec = binaryCodec{}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Magic() byte {
+	return 0xca
+}
+
+func (c binaryCodec) Encode(m *Message) ([]byte, error) {
+	b := make([]byte, 0, 128)
+	b = append(b, c.Magic())
+	b = binary.AppendUvarint(b, uint64(m.Version))
+	b = appendString(b, string(m.Type))
+	b = appendString(b, m.ID)
+	b = appendString(b, m.Node)
+	b = binary.AppendUvarint(b, m.Seq)
+	b = binary.AppendVarint(b, m.Time)
+	b = appendString(b, m.Reason)
+	b = appendString(b, m.Group)
+	b = appendString(b, m.Tag)
+	b = appendString(b, m.Prefix)
+	b = binary.AppendUvarint(b, uint64(m.Hops))
+
+	keys := m.Keys
+	if m.Key != nil {
+		keys = append([][]byte{m.Key}, keys...)
+	}
+	b = binary.AppendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = appendString(b, string(k))
+	}
+	return b, nil
+}
+
+func (c binaryCodec) Decode(b []byte) (*Message, error) {
+	if len(b) == 0 || b[0] != c.Magic() {
+		return nil, fmt.Errorf("%w: not a binary message", ErrInvalidMessage)
+	}
+	r := reader{b: b[1:]}
+	m := &Message{}
+	m.Version = int(r.uvarint())
+	m.Type = MessageType(r.string())
+	m.ID = r.string()
+	m.Node = r.string()
+	m.Seq = r.uvarint()
+	m.Time = r.varint()
+	m.Reason = r.string()
+	m.Group = r.string()
+	m.Tag = r.string()
+	m.Prefix = r.string()
+	m.Hops = int(r.uvarint())
+
+	count := r.uvarint()
+	if count > uint64(len(r.b)) { // At least one byte per key
+		return nil, fmt.Errorf("%w: too many keys", ErrInvalidMessage)
+	}
+	for i := uint64(0); i < count; i++ {
+		k := r.bytes()
+		if count == 1 {
+			m.Key = k
+		} else {
+			m.Keys = append(m.Keys, k)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return m, nil
+}
+
+func (binaryCodec) EncodeKey(key any) ([]byte, error) {
+	return appendKey(nil, reflect.ValueOf(key))
+}
+
+func (binaryCodec) DecodeKey(b []byte, key any) error {
+	v := reflect.ValueOf(key)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("%w: %T is not a pointer", ErrUnsupportedKey, key)
+	}
+	r := reader{b: b}
+	if err := readKey(&r, v.Elem()); err != nil {
+		return err
+	}
+	if r.err == nil && len(r.b) > 0 {
+		return fmt.Errorf("%w: trailing bytes in key", ErrInvalidMessage)
+	}
+	return r.err
+}
+
+var (
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	textMarshalerType     = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+func appendKey(b []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return nil, fmt.Errorf("%w: nil", ErrUnsupportedKey)
+	}
+	t := v.Type()
+	if t.Implements(binaryMarshalerType) {
+		data, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		return appendString(b, string(data)), err
+	}
+	if t.Implements(textMarshalerType) {
+		data, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		return appendString(b, string(data)), err
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return appendString(b, v.String()), nil
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return binary.AppendUvarint(b, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v.Float())), nil
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(real(c)))
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(imag(c))), nil
+	case reflect.Array:
+		var err error
+		for i := 0; i < v.Len() && err == nil; i++ {
+			b, err = appendKey(b, v.Index(i))
+		}
+		return b, err
+	case reflect.Struct:
+		var err error
+		for i := 0; i < v.NumField() && err == nil; i++ {
+			if !t.Field(i).IsExported() {
+				return nil, fmt.Errorf("%w: unexported field %s of %s", ErrUnsupportedKey, t.Field(i).Name, t)
+			}
+			b, err = appendKey(b, v.Field(i))
+		}
+		return b, err
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedKey, t)
+}
+
+func readKey(r *reader, v reflect.Value) error {
+	t := v.Type()
+	if reflect.PointerTo(t).Implements(binaryUnmarshalerType) && t.Implements(binaryMarshalerType) {
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(r.bytes())
+	}
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) && t.Implements(textMarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(r.bytes())
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(r.string())
+	case reflect.Bool:
+		v.SetBool(r.byte() != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(r.varint())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v.SetUint(r.uvarint())
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(math.Float64frombits(r.uint64()))
+	case reflect.Complex64, reflect.Complex128:
+		re := math.Float64frombits(r.uint64())
+		v.SetComplex(complex(re, math.Float64frombits(r.uint64())))
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := readKey(r, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				return fmt.Errorf("%w: unexported field %s of %s", ErrUnsupportedKey, t.Field(i).Name, t)
+			}
+			if err := readKey(r, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedKey, t)
+	}
+	return r.err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// Reads the fields of a binary message. The first error is kept, and the
+// next reads return zero values.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: truncated", ErrInvalidMessage)
+	}
+	r.b = nil
+}
+
+func (r *reader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) varint() int64 {
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if len(r.b) < 1 {
+		r.fail()
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) uint64() uint64 {
+	if len(r.b) < 8 {
+		r.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	size := r.uvarint()
+	if size > uint64(len(r.b)) {
+		r.fail()
+		return nil
+	}
+	v := r.b[:size:size]
+	r.b = r.b[size:]
+	return v
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
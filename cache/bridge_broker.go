@@ -0,0 +1,213 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+type BridgeConfig struct {
+	// Relays the messages received from a broker to the other brokers, for
+	// example between the NATS of one region and the Redis of another
+	Forward bool
+
+	MaxHops     int           // Messages forwarded that many times are not forwarded anymore
+	DedupWindow time.Duration // How long the IDs of the messages are remembered
+}
+
+var DefaultBridgeConfig = BridgeConfig{MaxHops: 3, DedupWindow: 10 * time.Minute}
+
+// BridgeBroker is a MessageBroker publishing the messages to several brokers,
+// and merging their subscriptions. A message received from several brokers is
+// delivered once, based on its ID.
+//
+// With Forward, the messages of a broker are relayed to the other ones. Loops
+// between bridges are prevented by the IDs, and by the number of hops recorded
+// in the message.
+type BridgeBroker struct {
+	config  BridgeConfig
+	brokers []MessageBroker
+	closers []io.Closer
+
+	mu       sync.Mutex
+	handlers map[uint64]func(msg []byte)
+	nextID   uint64
+	seen     map[string]struct{} // IDs of the messages received or sent
+	previous map[string]struct{} // IDs of the previous window
+	rotated  time.Time
+}
+
+var (
+	_ MessageBroker      = (*BridgeBroker)(nil)
+	_ ConnectionNotifier = (*BridgeBroker)(nil)
+)
+
+// NewBridgeBroker subscribes to the brokers, and returns a broker sending to all of them
+func NewBridgeBroker(config BridgeConfig, brokers ...MessageBroker) (*BridgeBroker, error) {
+	if config.MaxHops <= 0 {
+		config.MaxHops = DefaultBridgeConfig.MaxHops
+	}
+	if config.DedupWindow <= 0 {
+		config.DedupWindow = DefaultBridgeConfig.DedupWindow
+	}
+	b := &BridgeBroker{
+		config:   config,
+		brokers:  brokers,
+		handlers: make(map[uint64]func(msg []byte)),
+		seen:     make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+		rotated:  time.Now(),
+	}
+	for i, broker := range brokers {
+		i := i
+		closer, err := broker.Subscribe(func(msg []byte) { b.receive(i, msg) })
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.closers = append(b.closers, closer)
+	}
+	return b, nil
+}
+
+// Implement MessageBroker. Returns the errors of the brokers that failed,
+// the message is still sent to the other ones.
+func (b *BridgeBroker) Send(msg []byte) error {
+	if cm, err := decodeMessage(msg); err == nil {
+		b.isDuplicate(cm.ID) // Not delivered when received back
+	}
+	return b.sendExcept(-1, msg)
+}
+
+// Implement MessageBroker
+func (b *BridgeBroker) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+	var cf closerFunc = func() error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+		return nil
+	}
+	return cf, nil
+}
+
+// Implement ConnectionNotifier, for the brokers implementing it
+func (b *BridgeBroker) OnConnectionEvent(handler func(event ConnectionEvent)) io.Closer {
+	var closers []io.Closer
+	for _, broker := range b.brokers {
+		if cn, ok := broker.(ConnectionNotifier); ok {
+			closers = append(closers, cn.OnConnectionEvent(handler))
+		}
+	}
+	var cf closerFunc = func() error {
+		var errs []error
+		for _, c := range closers {
+			errs = append(errs, c.Close())
+		}
+		return errors.Join(errs...)
+	}
+	return cf
+}
+
+// Close unsubscribes from the brokers. The brokers are not closed.
+func (b *BridgeBroker) Close() error {
+	var errs []error
+	for _, c := range b.closers {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *BridgeBroker) sendExcept(except int, msg []byte) error {
+	var errs []error
+	for i, broker := range b.brokers {
+		if i == except {
+			continue
+		}
+		if err := broker.Send(msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Delivers a message received from a broker, once, and forwards it to the other brokers
+func (b *BridgeBroker) receive(from int, msg []byte) {
+	cm, err := decodeMessage(msg)
+	if err != nil {
+		log.Printf("Warn - bridge: invalid message: %v", err)
+		return
+	}
+	if b.isDuplicate(cm.ID) {
+		return
+	}
+
+	b.mu.Lock()
+	handlers := make([]func(msg []byte), 0, len(b.handlers))
+	for _, h := range b.handlers {
+		handlers = append(handlers, h)
+	}
+	b.mu.Unlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+
+	if !b.config.Forward || cm.Hops >= b.config.MaxHops {
+		return
+	}
+	if cm.Version <= messageVersion { // Otherwise forwarded as is, to keep the fields unknown here
+		cm.Hops++
+		if msg, err = cm.codec.Encode(cm); err != nil {
+			log.Printf("Warn - bridge: cannot forward message %s: %v", cm.ID, err)
+			return
+		}
+	}
+	if err := b.sendExcept(from, msg); err != nil {
+		log.Printf("Warn - bridge: cannot forward message %s: %v", cm.ID, err)
+	}
+}
+
+// Records the ID of a message, and returns true if it was already recorded.
+// Legacy messages have no ID and are never duplicates.
+func (b *BridgeBroker) isDuplicate(id string) bool {
+	if id == "" {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now := time.Now(); now.Sub(b.rotated) > b.config.DedupWindow {
+		b.previous, b.seen = b.seen, make(map[string]struct{})
+		b.rotated = now
+	}
+	if _, ok := b.seen[id]; ok {
+		return true
+	}
+	if _, ok := b.previous[id]; ok {
+		return true
+	}
+	b.seen[id] = struct{}{}
+	return false
+}
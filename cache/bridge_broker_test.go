@@ -0,0 +1,126 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Counts the messages received, by ID
+type messageCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *messageCounter) handler(msg []byte) {
+	cm, _ := decodeMessage(msg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[cm.ID]++
+}
+
+func (c *messageCounter) count(id string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[id]
+}
+
+func newBridge(t *testing.T, config BridgeConfig, brokers ...MessageBroker) *BridgeBroker {
+	b, err := NewBridgeBroker(config, brokers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func testMessage(t *testing.T) (string, []byte) {
+	cm := newMessage(msgClear, "group", newID())
+	b, err := BinaryCodec.Encode(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cm.ID, b
+}
+
+func TestBridgeDeduplicates(t *testing.T) {
+	nats, redis := NewMemoryBroker(DefaultMemoryBrokerConfig), NewMemoryBroker(DefaultMemoryBrokerConfig)
+	sender := newBridge(t, DefaultBridgeConfig, nats, redis)
+	receiver := newBridge(t, DefaultBridgeConfig, nats, redis)
+	counter := &messageCounter{}
+	receiver.Subscribe(counter.handler)
+	own := &messageCounter{}
+	sender.Subscribe(own.handler)
+
+	id, msg := testMessage(t)
+	if err := sender.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if counter.count(id) != 1 {
+		t.Errorf("message should be delivered once, got %d", counter.count(id))
+	}
+	if own.count(id) != 0 {
+		t.Errorf("own message should not be delivered, got %d", own.count(id))
+	}
+}
+
+func TestBridgeForward(t *testing.T) {
+	region1, region2 := NewMemoryBroker(DefaultMemoryBrokerConfig), NewMemoryBroker(DefaultMemoryBrokerConfig)
+	forward := BridgeConfig{Forward: true}
+	// Two gateways between the regions, which could loop
+	newBridge(t, forward, region1, region2)
+	newBridge(t, forward, region2, region1)
+
+	sent1, sent2 := &messageCounter{}, &messageCounter{}
+	region1.Subscribe(sent1.handler)
+	region2.Subscribe(sent2.handler)
+	receiver := newBridge(t, DefaultBridgeConfig, region2)
+	counter := &messageCounter{}
+	receiver.Subscribe(counter.handler)
+
+	id, msg := testMessage(t)
+	region1.Send(msg)
+	time.Sleep(50 * time.Millisecond)
+	if counter.count(id) != 1 {
+		t.Errorf("message should be delivered once in the other region, got %d", counter.count(id))
+	}
+	// The original message, and a copy forwarded by each gateway
+	if total := sent1.count(id) + sent2.count(id); total != 3 {
+		t.Errorf("message should be forwarded once by each gateway, got %d messages", total)
+	}
+}
+
+func TestBridgeMaxHops(t *testing.T) {
+	region1, region2 := NewMemoryBroker(DefaultMemoryBrokerConfig), NewMemoryBroker(DefaultMemoryBrokerConfig)
+	newBridge(t, BridgeConfig{Forward: true, MaxHops: 2}, region1, region2)
+	counter := &messageCounter{}
+	region2.Subscribe(counter.handler)
+
+	cm := newMessage(msgClear, "group", newID())
+	cm.Hops = 2
+	msg, _ := BinaryCodec.Encode(cm)
+	region1.Send(msg)
+	time.Sleep(20 * time.Millisecond)
+	if counter.count(cm.ID) != 0 {
+		t.Errorf("message should not be forwarded after max hops, got %d", counter.count(cm.ID))
+	}
+}
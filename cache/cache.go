@@ -16,7 +16,12 @@ limitations under the License.
 package cache
 
 import (
+	"encoding/json"
+	"io"
 	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -26,8 +31,47 @@ var (
 	defaultMessageBroker MessageBroker
 	// To avoid instanciating the same group twice for the same store
 	allGroups = map[string][]Store{}
+	// All the groups created, for operations across groups
+	registeredGroups   []registeredGroup
+	registeredGroupsMu sync.Mutex
 )
 
+// Non generic view of a group, for operations across groups
+type registeredGroup interface {
+	groupName() string
+	invalidateTag(tag string, broadcast bool)
+	delJSON(keys []json.RawMessage) error
+	Clear()
+}
+
+func register(g registeredGroup) {
+	registeredGroupsMu.Lock()
+	defer registeredGroupsMu.Unlock()
+	registeredGroups = append(registeredGroups, g)
+}
+
+func unregister(g registeredGroup) {
+	registeredGroupsMu.Lock()
+	defer registeredGroupsMu.Unlock()
+	if i := slices.Index(registeredGroups, g); i >= 0 {
+		registeredGroups = slices.Delete(registeredGroups, i, i+1)
+	}
+}
+
+// InvalidateTag deletes the entries carrying the tag in all the groups, in the
+// first and second level stores, and notifies the other nodes so they do the same.
+//
+// Entries of the second level store are only found if it implements TagStore.
+func InvalidateTag(tag string) {
+	registeredGroupsMu.Lock()
+	groups := append([]registeredGroup{}, registeredGroups...)
+	registeredGroupsMu.Unlock()
+
+	for _, g := range groups {
+		g.invalidateTag(tag, true)
+	}
+}
+
 // SetDefaultStore sets the default Store. Only applies to the groups created after this call.
 func SetDefaultStore(store Store) {
 	defaultStore = store
@@ -42,7 +86,9 @@ type Group[K comparable, V any] struct {
 	store  Store // The underlying cache engine
 	store2 Store // Second level store
 	name   string
-	load   func(key K) (V, error)
+	name2  string // Name of the group in the second level store, including the schema version
+	node   string // Unique identifier of this group, as the sender of messages
+	load   func(key K) (V, []string, error)
 
 	// loadGroup ensures that each key is only fetched once
 	// (either locally or remotely), regardless of the number of
@@ -51,9 +97,23 @@ type Group[K comparable, V any] struct {
 
 	// messageBroker is used for clustered events like flushing of entries
 	messageBroker MessageBroker
+	outbox        *outbox     // Queue of the messages to send through the broker
+	dispatcher    *dispatcher // Subscription delivering the messages of the broker
+	closeOnce     sync.Once
+	eventHandlers []io.Closer // Registrations of the connection events handlers
 
 	debug          bool // debug enabled
 	reloadOnDelete bool // reload on Deletes
+
+	schemaUpgrade *schemaUpgrade[V] // Migration of entries from a previous schema version
+
+	tags tagIndex[K] // Tags of the entries of the first level store
+
+	sequences      sequences      // To detect missed messages
+	recoveryAction RecoveryAction // When messages have been missed
+
+	disconnectPolicy DisconnectPolicy
+	disconnected     atomic.Bool // Broker disconnected
 }
 
 // flightGroup is defined as an interface which flightgroup.Group
@@ -65,39 +125,61 @@ type flightGroup[K comparable, V any] interface {
 
 func (g *Group[K, V]) Get(key K) (V, error) {
 	gk := g.store.Key(g.name, key)
-	if v, err := g.store.Get(gk); err == nil || err != ErrKeyNotFound {
-		return v.(V), err
+	if !g.bypass() { // Otherwise it may be stale
+		if v, err := g.store.Get(gk); err == nil {
+			return v.(V), nil
+		} else if err != ErrKeyNotFound {
+			return *new(V), err
+		}
 	}
 
-	if g.store2 != nil { // Fetch from the second level store
-		gk2 := g.store2.Key(g.name, key)
-		if v, err := g.store2.Get(gk2); err == nil || err != ErrKeyNotFound {
-			return v.(V), err
+	if g.secondLevelHealthy() { // Fetch from the second level store
+		gk2 := g.store2.Key(g.name2, key)
+		if v, err := g.store2.Get(gk2); err == nil {
+			return v.(V), nil
+		} else if err != ErrKeyNotFound {
+			return *new(V), err
 		}
 	}
 
 	return g.loadAndSet(key, gk)
 }
 
+// Whether the second level store is set and can be used
+func (g *Group[K, V]) secondLevelHealthy() bool {
+	if g.store2 == nil {
+		return false
+	}
+	hc, ok := g.store2.(HealthChecker)
+	return !ok || hc.Healthy()
+}
+
 func (g *Group[K, V]) loadAndSet(key K, gk GroupKey) (V, error) {
 	loadAndSetFunc := func() (V, error) {
-		g.log("loading key %v", key)
-		// Not found in cache, using loader
-		v, err := g.load(key)
-		if err != nil {
-			return v, err
+		var tags []string
+		v, ok := g.upgrade(key)
+		if !ok {
+			g.log("loading key %v", key)
+			// Not found in cache, using loader
+			var err error
+			v, tags, err = g.load(key)
+			if err != nil {
+				return v, err
+			}
 		}
 
 		// Set the value
-		err = g.store.Set(gk, v)
-		if err != nil {
-			return v, err
+		if !g.bypass() {
+			if err := g.store.Set(gk, v); err != nil {
+				return v, err
+			}
+			g.tags.set(key, tags)
 		}
 
 		// Set the value on the second level store
-		if g.store2 != nil {
-			gk2 := g.store2.Key(g.name, key)
-			go g.store2.Set(gk2, v) // Async
+		if g.secondLevelHealthy() {
+			gk2 := g.store2.Key(g.name2, key)
+			go g.setSecondLevel(gk2, v, tags) // Async
 		}
 
 		return v, nil
@@ -109,16 +191,70 @@ func (g *Group[K, V]) loadAndSet(key K, gk GroupKey) (V, error) {
 	return loadAndSetFunc()
 }
 
+// Set replaces the value of an entry in the stores, and notifies the other
+// nodes so they drop their local copy.
+func (g *Group[K, V]) Set(key K, value V) error {
+	if err := g.store.Set(g.store.Key(g.name, key), value); err != nil {
+		return err
+	}
+	if g.secondLevelHealthy() {
+		if err := g.store2.Set(g.store2.Key(g.name2, key), value); err != nil {
+			return err
+		}
+	} else if g.store2 != nil {
+		// Bypassed while unhealthy, but its previous value must not be read once healthy again
+		if err := g.store2.Del(g.store2.Key(g.name2, key)); err != nil {
+			g.warn("cannot delete key %v in unhealthy second level store: %v", key, err)
+		}
+	}
+	g.sendKey(msgSet, key)
+	return nil
+}
+
 func (g *Group[K, V]) Del(key K) {
 	g.delNoFlush(key, true)
-	if g.messageBroker != nil {
-		msg := cacheMsg[K]{Group: g.name, Key: key}
-		g.log("send flush key %v", key)
-		go g.messageBroker.Send(msg.bytes()) // async call
-	}
+	g.sendKey(msgDel, key)
+}
+
+// Clear deletes all the entries of the group, in the stores that support it
+// (see Clearer), and notifies the other nodes.
+func (g *Group[K, V]) Clear() {
+	g.clearNoFlush(true)
+	g.send(g.message(msgClear))
+}
+
+// Close unregisters the group: it does not receive messages nor connection events
+// anymore, and is not reached by the operations across groups (InvalidateTag,
+// webhook). The outbox
+// and the subscription of the broker are closed with the last group using them.
+// The group must not be used afterwards, and its name can be used again.
+func (g *Group[K, V]) Close() {
+	g.closeOnce.Do(func() {
+		for _, h := range g.eventHandlers {
+			if err := h.Close(); err != nil {
+				g.warn("cannot unregister connection events handler: %v", err)
+			}
+		}
+		unregister(g)
+		if g.dispatcher != nil {
+			g.dispatcher.unsubscribe(g.name, g)
+		}
+		if g.outbox != nil {
+			g.outbox.release() // Sends the pending messages
+		}
+		if stores := allGroups[g.name]; len(stores) > 1 {
+			allGroups[g.name] = stores[1:] // Only their number matters
+		} else {
+			delete(allGroups, g.name)
+		}
+	})
 }
 
 func (g *Group[K, V]) delNoFlush(key K, deleteSecondLevel bool) {
+	if g.store2 != nil && deleteSecondLevel && g.schemaUpgrade != nil {
+		// Otherwise the entry of the previous version would be upgraded again
+		g.store2.Del(g.store2.Key(g.schemaUpgrade.name, key))
+	}
 	gk := g.store.Key(g.name, key)
 	if g.reloadOnDelete {
 		g.log("reload key %v", key)
@@ -126,20 +262,38 @@ func (g *Group[K, V]) delNoFlush(key K, deleteSecondLevel bool) {
 	} else {
 		g.log("delete key %v", key)
 		g.store.Del(gk)
+		g.tags.del(key)
 		// Delete the value on the second level store
 		if g.store2 != nil && deleteSecondLevel {
-			gk2 := g.store.Key(g.name, key)
+			gk2 := g.store2.Key(g.name2, key)
 			g.store2.Del(gk2)
 		}
 	}
 }
 
+func (g *Group[K, V]) clearNoFlush(clearSecondLevel bool) {
+	g.log("clear")
+	if c, ok := g.store.(Clearer); ok {
+		c.Clear(g.name)
+		g.tags.clear()
+	} else {
+		g.warn("store does not support clear")
+	}
+	if g.store2 != nil && clearSecondLevel {
+		if c, ok := g.store2.(Clearer); ok {
+			c.Clear(g.name2)
+		} else {
+			g.warn("second level store does not support clear")
+		}
+	}
+}
+
 func (g *Group[K, V]) log(message string, args ...any) {
 	if g.debug {
-		log.Printf("group(%s): "+message, g.name, args)
+		log.Printf("group(%s): "+message, append([]any{g.name}, args...)...)
 	}
 }
 
 func (g *Group[K, V]) warn(message string, args ...any) {
-	log.Printf("Warn - group(%s): "+message, g.name, args)
+	log.Printf("Warn - group(%s): "+message, append([]any{g.name}, args...)...)
 }
@@ -0,0 +1,173 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+var ErrInvalidMessage = errors.New("invalid message")
+
+// MessageCodec encodes the messages sent through a broker. The keys are encoded
+// separately, so that they are only decoded by the groups they are meant for.
+//
+// Receivers select the codec of a message by its first byte, so nodes sending
+// with different codecs can coexist, for example during a rollout.
+type MessageCodec interface {
+	// First byte of the encoded messages. Must be unique among the registered codecs.
+	Magic() byte
+	Encode(m *Message) ([]byte, error)
+	Decode(b []byte) (*Message, error)
+
+	EncodeKey(key any) ([]byte, error)
+	// Decodes a key into a pointer to a key
+	DecodeKey(b []byte, key any) error
+}
+
+var (
+	// Codec used to send messages, unless set with SetMessageCodec. The
+	// receivers decode the messages of all the registered codecs.
+	//
+	// Nodes of previous versions only decode JSON: in a cluster mixing them with
+	// upgraded nodes, set JSONCodec until all the nodes are upgraded.
+	DefaultMessageCodec MessageCodec = BinaryCodec
+
+	// Registered codecs by magic byte
+	messageCodecs = map[byte]MessageCodec{JSONCodec.Magic(): JSONCodec, BinaryCodec.Magic(): BinaryCodec,
+		TextCodec.Magic(): TextCodec}
+	// Codecs used to send messages, by broker
+	codecs = map[MessageBroker]MessageCodec{}
+
+	messageCodecsMu sync.RWMutex
+)
+
+// RegisterMessageCodec registers a custom codec, so that its messages can be received
+func RegisterMessageCodec(codec MessageCodec) {
+	messageCodecsMu.Lock()
+	defer messageCodecsMu.Unlock()
+	messageCodecs[codec.Magic()] = codec
+}
+
+// SetMessageCodec sets the codec of the messages sent through the broker, and
+// registers it. Only applies if called before the first group using the broker
+// is created.
+//
+// Nodes of previous versions only decode JSON: set JSONCodec for the brokers
+// they are connected to until they are upgraded (see DefaultMessageCodec).
+func SetMessageCodec(broker MessageBroker, codec MessageCodec) {
+	RegisterMessageCodec(codec)
+	if !isComparable(broker) {
+		log.Printf("Warn - message codec ignored, broker %T is not comparable", broker)
+		return
+	}
+	outboxesMu.Lock()
+	defer outboxesMu.Unlock()
+	codecs[broker] = codec
+}
+
+// Codec of the messages sent through the broker. Must be called with outboxesMu held.
+func codecFor(broker MessageBroker) MessageCodec {
+	if !isComparable(broker) {
+		return DefaultMessageCodec
+	}
+	if codec, ok := codecs[broker]; ok {
+		return codec
+	}
+	return DefaultMessageCodec
+}
+
+// Decodes a message with the codec matching its first byte
+func decodeMessage(b []byte) (*Message, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidMessage)
+	}
+	messageCodecsMu.RLock()
+	codec, ok := messageCodecs[b[0]]
+	messageCodecsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown codec 0x%02x", ErrInvalidMessage, b[0])
+	}
+	m, err := codec.Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	m.codec = codec
+	return m, nil
+}
+
+// JSONCodec encodes the messages and the keys in JSON. Messages without
+// version are legacy messages, holding only a group and a key to delete.
+var JSONCodec MessageCodec = jsonCodec{}
+
+type jsonCodec struct{}
+
+// JSON representation of a Message
+type jsonMessage struct {
+	Version int               `json:"v"`
+	Type    MessageType       `json:"type"`
+	ID      string            `json:"id"`
+	Node    string            `json:"node"`
+	Seq     uint64            `json:"seq,omitempty"`
+	Time    int64             `json:"ts"`
+	Reason  string            `json:"reason,omitempty"`
+	Group   string            `json:"group"`
+	Key     json.RawMessage   `json:"key,omitempty"`
+	Keys    []json.RawMessage `json:"keys,omitempty"`
+	Tag     string            `json:"tag,omitempty"`
+	Prefix  string            `json:"prefix,omitempty"`
+	Hops    int               `json:"hops,omitempty"`
+}
+
+func (jsonCodec) Magic() byte {
+	return '{'
+}
+
+func (jsonCodec) Encode(m *Message) ([]byte, error) {
+	jm := jsonMessage{Version: m.Version, Type: m.Type, ID: m.ID, Node: m.Node, Seq: m.Seq, Time: m.Time,
+		Reason: m.Reason, Group: m.Group, Key: m.Key, Tag: m.Tag, Prefix: m.Prefix, Hops: m.Hops}
+	for _, k := range m.Keys {
+		jm.Keys = append(jm.Keys, k)
+	}
+	return json.Marshal(jm)
+}
+
+func (jsonCodec) Decode(b []byte) (*Message, error) {
+	jm := jsonMessage{}
+	if err := json.Unmarshal(b, &jm); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	m := &Message{Version: jm.Version, Type: jm.Type, ID: jm.ID, Node: jm.Node, Seq: jm.Seq, Time: jm.Time,
+		Reason: jm.Reason, Group: jm.Group, Key: jm.Key, Tag: jm.Tag, Prefix: jm.Prefix, Hops: jm.Hops}
+	for _, k := range jm.Keys {
+		m.Keys = append(m.Keys, k)
+	}
+	if m.Version == 0 { // Legacy flush message
+		m.Type = msgDel
+	}
+	return m, nil
+}
+
+func (jsonCodec) EncodeKey(key any) ([]byte, error) {
+	return json.Marshal(key)
+}
+
+func (jsonCodec) DecodeKey(b []byte, key any) error {
+	return json.Unmarshal(b, key)
+}
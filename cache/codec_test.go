@@ -0,0 +1,182 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []MessageCodec{JSONCodec, BinaryCodec, TextCodec} {
+		cm := newMessage(msgDel, "group", "node")
+		cm.Seq = 42
+		cm.Reason = "reason"
+		cm.Hops = 1
+		k1, _ := codec.EncodeKey("key1")
+		k2, _ := codec.EncodeKey("key2")
+		cm.Keys = [][]byte{k1, k2}
+
+		b, err := codec.Encode(cm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeMessage(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.codec != codec {
+			t.Errorf("codec should be detected from the message, got %T", decoded.codec)
+		}
+		decoded.codec = nil
+		if !reflect.DeepEqual(cm, decoded) {
+			t.Errorf("%T: message should be decoded as %+v, got %+v", codec, cm, decoded)
+		}
+	}
+}
+
+func TestBinaryCodecInvalidMessages(t *testing.T) {
+	cm := newMessage(msgClear, "group", "node")
+	b, _ := BinaryCodec.Encode(cm)
+	if _, err := decodeMessage(b[:len(b)-3]); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("truncated message should be invalid, got %v", err)
+	}
+	if _, err := decodeMessage([]byte{0x01, 0x02}); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("message of unknown codec should be invalid, got %v", err)
+	}
+}
+
+type compositeKey struct {
+	Tenant int
+	Name   string
+	Active bool
+	Scores [2]float64
+}
+
+type privateKey struct {
+	id int
+}
+
+func testKey[K comparable](t *testing.T, key K) {
+	t.Helper()
+	b, err := BinaryCodec.EncodeKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded K
+	if err := BinaryCodec.DecodeKey(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != key {
+		t.Errorf("key should be decoded as %v, got %v", key, decoded)
+	}
+}
+
+func TestBinaryCodecKeys(t *testing.T) {
+	testKey(t, "key")
+	testKey(t, "")
+	testKey(t, -42)
+	testKey(t, uint8(200))
+	testKey(t, 3.14)
+	testKey(t, compositeKey{Tenant: 42, Name: "name", Active: true, Scores: [2]float64{1, 2}})
+	testKey(t, [16]byte{1, 2, 3}) // UUID
+	testKey(t, netip.MustParseAddr("10.0.0.1"))
+
+	if _, err := BinaryCodec.EncodeKey(privateKey{id: 1}); !errors.Is(err, ErrUnsupportedKey) {
+		t.Errorf("keys with unexported fields should be reported, got %v", err)
+	}
+	var decoded privateKey
+	if err := BinaryCodec.DecodeKey([]byte{2}, &decoded); !errors.Is(err, ErrUnsupportedKey) {
+		t.Errorf("keys with unexported fields should be reported, got %v", err)
+	}
+}
+
+func TestTextCodecKeys(t *testing.T) {
+	var s string
+	var i int64
+	var addr netip.Addr
+	for _, c := range []struct {
+		text string
+		key  any
+		want any
+	}{{"tenant:42", &s, "tenant:42"}, {"-42", &i, int64(-42)}, {"10.0.0.1", &addr, netip.MustParseAddr("10.0.0.1")}} {
+		if err := TextCodec.DecodeKey([]byte(c.text), c.key); err != nil {
+			t.Fatal(err)
+		}
+		if got := reflect.ValueOf(c.key).Elem().Interface(); got != c.want {
+			t.Errorf("key should be decoded as %v, got %v", c.want, got)
+		}
+		if b, _ := TextCodec.EncodeKey(c.want); string(b) != c.text {
+			t.Errorf("key should be encoded as %s, got %s", c.text, b)
+		}
+	}
+	if err := TextCodec.DecodeKey([]byte("abc"), &i); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("invalid number should be reported, got %v", err)
+	}
+	var k compositeKey
+	if err := TextCodec.DecodeKey([]byte("abc"), &k); !errors.Is(err, ErrUnsupportedKey) {
+		t.Errorf("struct keys should not be supported, got %v", err)
+	}
+}
+
+func TestMixedCodecs(t *testing.T) {
+	g, counter := newCountingGroup("TestMixedCodecs")
+	g.Get("key1")
+	g.Get("key2")
+
+	for _, codec := range []MessageCodec{JSONCodec, BinaryCodec} {
+		cm := newMessage(msgDel, "TestMixedCodecs", newID())
+		if codec == JSONCodec {
+			cm.Key, _ = codec.EncodeKey("key1")
+		} else {
+			cm.Key, _ = codec.EncodeKey("key2")
+		}
+		b, _ := codec.Encode(cm)
+		receive(g, b)
+	}
+	g.Get("key1")
+	g.Get("key2")
+	if *counter != 4 {
+		t.Errorf("messages of both codecs should be handled, got %d loads", *counter)
+	}
+}
+
+func TestInvalidatorWithCodec(t *testing.T) {
+	broker := &recordingBroker{}
+	i := NewInvalidator(broker).WithCodec(TextCodec)
+	if err := i.Del("TestInvalidatorWithCodec", 42); err != nil {
+		t.Fatal(err)
+	}
+	if len(broker.sent) != 1 || broker.sent[0][0] != TextCodec.Magic() {
+		t.Errorf("message should be encoded with the text codec, got %q", broker.sent)
+	}
+	outboxesMu.Lock()
+	_, ok := codecs[broker]
+	outboxesMu.Unlock()
+	if ok {
+		t.Errorf("codec should not be set for the broker")
+	}
+}
+
+func TestDefaultMessageCodec(t *testing.T) {
+	broker := &recordingBroker{}
+	NewInvalidator(broker).Del("TestDefaultMessageCodec", "key")
+	if len(broker.sent) != 1 || broker.sent[0][0] != BinaryCodec.Magic() {
+		t.Errorf("messages should be binary by default, got %q", broker.sent)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"io"
+	"log"
+	"slices"
+	"sync"
+)
+
+var (
+	// One subscription per broker
+	dispatchers   = map[MessageBroker]*dispatcher{}
+	dispatchersMu sync.Mutex
+)
+
+// Group receiving messages from a dispatcher
+type messageHandler interface {
+	handle(cm *Message)
+}
+
+// Subscribes once to a broker, and dispatches the messages to the groups by name.
+// Messages are decoded once, except their keys that are decoded by the groups.
+type dispatcher struct {
+	broker       MessageBroker
+	mu           sync.RWMutex
+	groups       map[string][]messageHandler // By group name
+	subscription io.Closer
+}
+
+// Registers a group to receive the messages of the broker, subscribing
+// to the broker for the first group
+func subscribe(broker MessageBroker, name string, h messageHandler) *dispatcher {
+	dispatchersMu.Lock()
+	defer dispatchersMu.Unlock()
+	d := dispatcherFor(broker)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.groups[name] = append(d.groups[name], h)
+	return d
+}
+
+// Dispatcher of the broker, subscribed on first use. Must be called with dispatchersMu held.
+func dispatcherFor(broker MessageBroker) *dispatcher {
+	comparable := isComparable(broker)
+	if comparable {
+		if d, ok := dispatchers[broker]; ok {
+			return d
+		}
+	}
+	d := &dispatcher{broker: broker, groups: make(map[string][]messageHandler)}
+	subscription, err := broker.Subscribe(d.handleMessage)
+	if err != nil {
+		log.Printf("Warn - cannot subscribe to broker: %v", err)
+	} else if comparable {
+		dispatchers[broker] = d
+	}
+	d.subscription = subscription
+	return d
+}
+
+// Unregisters a group, closing the subscription once no group is registered
+func (d *dispatcher) unsubscribe(name string, h messageHandler) {
+	dispatchersMu.Lock()
+	d.mu.Lock()
+	if i := slices.Index(d.groups[name], h); i >= 0 {
+		d.groups[name] = slices.Delete(d.groups[name], i, i+1)
+	}
+	if len(d.groups[name]) == 0 {
+		delete(d.groups, name)
+	}
+	last := len(d.groups) == 0
+	d.mu.Unlock()
+	if last && isComparable(d.broker) && dispatchers[d.broker] == d {
+		delete(dispatchers, d.broker)
+	}
+	dispatchersMu.Unlock()
+	if last {
+		d.close()
+	}
+}
+
+// Closes the subscription. The groups do not receive messages anymore.
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	clear(d.groups)
+	subscription := d.subscription
+	d.subscription = nil
+	d.mu.Unlock()
+	if subscription != nil {
+		if err := subscription.Close(); err != nil {
+			log.Printf("Warn - cannot close subscription: %v", err)
+		}
+	}
+}
+
+func (d *dispatcher) handleMessage(msg []byte) {
+	cm, err := decodeMessage(msg)
+	if err != nil {
+		log.Printf("Warn - invalid message: %v", err)
+		return
+	}
+	d.mu.RLock()
+	handlers := d.groups[cm.Group]
+	if cm.Type == msgTag && cm.Group == "" { // For all the groups, sent by an Invalidator
+		handlers = nil
+		for _, hs := range d.groups {
+			handlers = append(handlers, hs...)
+		}
+	}
+	d.mu.RUnlock()
+	for _, h := range handlers {
+		h.handle(cm)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDispatcher(t *testing.T) {
+	broker := &recordingBroker{}
+	var groups []*Group[string, int]
+	for i := 0; i < 3; i++ {
+		counter := 0
+		loader := func(key string) (int, error) {
+			counter++
+			return counter, nil
+		}
+		g := NewFactory(fmt.Sprintf("TestDispatcher%d", i), loader).WithStore(NewHashMapStore()).
+			WithBroker(broker).Cache()
+		g.Get("key")
+		groups = append(groups, g)
+	}
+
+	if len(broker.handlers) != 1 {
+		t.Errorf("broker should be subscribed once, got %d subscriptions", len(broker.handlers))
+	}
+
+	broker.Send(delMessage("TestDispatcher1", newID(), "key"))
+	for i, g := range groups {
+		expected := 1
+		if i == 1 {
+			expected = 2
+		}
+		if v, _ := g.Get("key"); v != expected {
+			t.Errorf("group %d: value should be %d, got %v", i, expected, v)
+		}
+	}
+}
+
+func TestGroupClose(t *testing.T) {
+	broker := &recordingBroker{}
+	closed := false
+	broker.closer = closerFunc(func() error {
+		closed = true
+		return nil
+	})
+	loader := func(key string) (int, error) {
+		return 1, nil
+	}
+	g1 := NewFactory("TestGroupClose1", loader).WithStore(NewHashMapStore()).WithBroker(broker).Cache()
+	g2 := NewFactory("TestGroupClose2", loader).WithStore(NewHashMapStore()).WithBroker(broker).Cache()
+
+	g1.Close()
+	g1.Close() // No effect
+	if len(groupsNamed("TestGroupClose1")) != 0 {
+		t.Errorf("closed group should be unregistered")
+	}
+	if closed {
+		t.Errorf("subscription should be kept for the other group")
+	}
+	g2.Close()
+	if !closed {
+		t.Errorf("subscription should be closed with the last group")
+	}
+	outboxesMu.Lock()
+	_, ok := outboxes[broker]
+	outboxesMu.Unlock()
+	if ok {
+		t.Errorf("outbox should be released with the last group")
+	}
+
+	// The name can be used again
+	NewFactory("TestGroupClose1", loader).WithStore(NewHashMapStore()).WithBroker(broker).Cache().Close()
+}
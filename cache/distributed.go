@@ -16,37 +16,129 @@ limitations under the License.
 package cache
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
 )
 
-// Cache Message. Only for flush events
-// Serialized to/from JSON and sent by the Message Broker.
-type cacheMsg[K comparable] struct {
-	Group string `json:"group"`
-	Key   K      `json:"key"`
+// Version of the message envelope. Messages with a higher version are ignored, so
+// that nodes can be upgraded one at a time. Messages without version (version 0)
+// are legacy flush messages, holding only a group and a key.
+const messageVersion = 1
+
+type MessageType string
+
+const (
+	msgDel    MessageType = "del"    // Entry deleted
+	msgClear  MessageType = "clear"  // All entries of the group deleted
+	msgSet    MessageType = "set"    // Entry replaced with a new value
+	msgTag    MessageType = "tag"    // Entries with a tag deleted
+	msgPrefix MessageType = "prefix" // Entries with a key starting with a prefix deleted
+)
+
+// Message for distributed invalidation, encoded by a MessageCodec and sent
+// by the message broker.
+//
+// The keys are kept in their encoded form, so that they are only decoded
+// by the group that the message is meant for.
+type Message struct {
+	Version int
+	Type    MessageType
+	ID      string
+	Node    string // Sender, to ignore our own messages
+	Seq     uint64 // Sequence number of the message for the sender
+	Time    int64  // Unix time in milliseconds
+	Reason  string
+	Group   string
+	Key     []byte   // Encoded with EncodeKey of the codec
+	Keys    [][]byte // Batch of keys
+	Tag     string
+	Prefix  string
+	Hops    int // Number of times forwarded by a BridgeBroker
+
+	codec MessageCodec // That decoded the message, to decode the keys
 }
 
-func (cm *cacheMsg[K]) bytes() []byte {
-	b, _ := json.Marshal(cm)
-	return b
+func newMessage(t MessageType, group string, node string) *Message {
+	return &Message{Version: messageVersion, Type: t, ID: newID(), Node: node,
+		Time: time.Now().UnixMilli(), Group: group}
 }
 
-func (g *Group[K, V]) fromBytes(b []byte) *cacheMsg[K] {
-	cm := cacheMsg[K]{}
-	json.Unmarshal(b, &cm)
-	return &cm
+// Random identifier, for nodes and messages
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-// Message handler function to process messages from
-// the message broker
-func (g *Group[K, V]) handleMessage(msg []byte) {
-	cm := g.fromBytes(msg)
-	g.log("handleMessage: %v", cm)
+func (g *Group[K, V]) message(t MessageType) *Message {
+	return newMessage(t, g.name, g.node)
+}
 
-	if cm.Group != g.name {
-		return // Ignore messages from other groups
+// Sends a message about a key to the other nodes. Keys are batched
+// with the other keys of the same type sent meanwhile.
+func (g *Group[K, V]) sendKey(t MessageType, key K) {
+	if g.messageBroker == nil {
+		return
+	}
+	k, err := g.outbox.codec.EncodeKey(key)
+	if err != nil {
+		g.warn("cannot send %s message for key %v: %v", t, key, err)
+		return
 	}
+	g.log("send %s key %v", t, key)
+	g.outbox.enqueue(g.message(t), k, &g.sequences, g.warn)
+}
+
+// Sends a message to the other nodes, asynchronously
+func (g *Group[K, V]) send(cm *Message) {
+	if g.messageBroker == nil {
+		return
+	}
+	g.log("send %s message %s", cm.Type, cm.ID)
+	g.outbox.enqueue(cm, nil, &g.sequences, g.warn)
+}
+
+// Processes a message for this group. The keys are only decoded here,
+// so that only the groups the message is meant for decode them.
+func (g *Group[K, V]) handle(cm *Message) {
+	if cm.Version > messageVersion {
+		g.log("ignoring message %s with version %d", cm.ID, cm.Version)
+		return
+	}
+	if cm.Node == g.node {
+		return // Sent by this group
+	}
+	if missed := g.sequences.receive(cm.Node, cm.Seq); missed > 0 {
+		g.recover(RecoveryEvent{Group: g.name, Reason: RecoveryGap, Sender: cm.Node, Missed: missed})
+	}
+	g.log("handleMessage: %s %s", cm.Type, cm.ID)
+
 	// Do not clear second level for distributed flush notification
 	// because this is the responsibility of the source event
-	g.delNoFlush(cm.Key, false)
+	switch cm.Type {
+	case msgDel, msgSet:
+		keys := cm.Keys
+		if cm.Key != nil {
+			keys = append(keys, cm.Key)
+		}
+		for _, k := range keys {
+			var key K
+			if err := cm.codec.DecodeKey(k, &key); err != nil {
+				g.warn("invalid key in message %s: %v", cm.ID, err)
+				continue
+			}
+			g.delNoFlush(key, false)
+		}
+	case msgClear:
+		g.clearNoFlush(false)
+	case msgTag:
+		g.invalidateTag(cm.Tag, false)
+	case msgPrefix:
+		if err := g.delPrefixNoFlush(cm.Prefix, false); err != nil {
+			g.warn("cannot delete prefix %s: %v", cm.Prefix, err)
+		}
+	default:
+		g.log("ignoring message %s with type %s", cm.ID, cm.Type)
+	}
 }
@@ -0,0 +1,121 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"testing"
+)
+
+func newCountingGroup(name string) (*Group[string, int], *int) {
+	counter := 0
+	loader := func(key string) (int, error) {
+		counter++
+		return counter, nil
+	}
+	return NewFactory(name, loader).WithStore(NewHashMapStore()).WithBroker(&recordingBroker{}).Cache(), &counter
+}
+
+// Delivers a message to a group, as received from its broker
+func receive[K comparable, V any](g *Group[K, V], msg []byte) {
+	g.dispatcher.handleMessage(msg)
+}
+
+func delMessage(group string, node string, key string) []byte {
+	cm := newMessage(msgDel, group, node)
+	cm.Key, _ = BinaryCodec.EncodeKey(key)
+	b, _ := BinaryCodec.Encode(cm)
+	return b
+}
+
+func TestHandleMessage(t *testing.T) {
+	g, counter := newCountingGroup("TestHandleMessage")
+	g.Get("key")
+
+	receive(g, delMessage("TestHandleMessage", newID(), "key"))
+	if v, _ := g.Get("key"); v != 2 || *counter != 2 {
+		t.Errorf("key should have been deleted and loaded again, got %v", v)
+	}
+}
+
+func TestHandleMessageIgnoresOwnMessages(t *testing.T) {
+	g, counter := newCountingGroup("TestHandleMessageIgnoresOwnMessages")
+	g.Get("key")
+
+	receive(g, delMessage("TestHandleMessageIgnoresOwnMessages", g.node, "key"))
+	if v, _ := g.Get("key"); v != 1 || *counter != 1 {
+		t.Errorf("own message should be ignored, got %v", v)
+	}
+}
+
+func TestHandleMessageVersions(t *testing.T) {
+	g, _ := newCountingGroup("TestHandleMessageVersions")
+	g.Get("key1")
+	g.Get("key2")
+
+	// Message from a newer version
+	cm := newMessage(msgDel, "TestHandleMessageVersions", newID())
+	cm.Version = messageVersion + 1
+	cm.Key, _ = BinaryCodec.EncodeKey("key1")
+	b, _ := BinaryCodec.Encode(cm)
+	receive(g, b)
+	if v, _ := g.Get("key1"); v != 1 {
+		t.Errorf("message with unknown version should be ignored, got %v", v)
+	}
+
+	// Legacy message, without version
+	receive(g, []byte(`{"group":"TestHandleMessageVersions","key":"key2"}`))
+	if v, _ := g.Get("key2"); v != 3 {
+		t.Errorf("legacy message should delete the key, got %v", v)
+	}
+}
+
+func TestHandleClearMessage(t *testing.T) {
+	g, _ := newCountingGroup("TestHandleClearMessage")
+	g.Get("key1")
+	g.Get("key2")
+
+	b, _ := BinaryCodec.Encode(newMessage(msgClear, "TestHandleClearMessage", newID()))
+	receive(g, b)
+	if v, _ := g.Get("key1"); v != 3 {
+		t.Errorf("group should have been cleared, got %v", v)
+	}
+	if v, _ := g.Get("key2"); v != 4 {
+		t.Errorf("group should have been cleared, got %v", v)
+	}
+}
+
+func TestHandleTagMessage(t *testing.T) {
+	counter := 0
+	loader := func(key string) (int, []string, error) {
+		counter++
+		return counter, []string{"tag-" + key}, nil
+	}
+	g := NewTaggedFactory("TestHandleTagMessage", loader).WithStore(NewHashMapStore()).
+		WithBroker(&recordingBroker{}).Cache()
+	g.Get("key1")
+	g.Get("key2")
+
+	cm := newMessage(msgTag, "TestHandleTagMessage", newID())
+	cm.Tag = "tag-key1"
+	b, _ := BinaryCodec.Encode(cm)
+	receive(g, b)
+	if v, _ := g.Get("key1"); v != 3 {
+		t.Errorf("entry with the tag should have been deleted, got %v", v)
+	}
+	if v, _ := g.Get("key2"); v != 2 {
+		t.Errorf("entry without the tag should still be cached, got %v", v)
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+var (
+	ErrDecryptionFailed = errors.New("cache entry could not be decrypted")
+	ErrNoEncryptionKey  = errors.New("no encryption key")
+)
+
+// Type of the values stored in the underlying store of an EncryptedStore
+var ciphertextType = reflect.TypeOf("")
+
+// Keyring holds the AES keys used by an EncryptedStore. Entries are always
+// encrypted with the current key, the other keys are only used to decrypt
+// entries written before a rotation. Those entries are re-encrypted with the
+// current key the next time they are set.
+type Keyring struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring creates a keyring with keyID as the current key. The key must be
+// 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func NewKeyring(keyID string, key []byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	if err := k.Rotate(keyID, key); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Add a key that is only used for decryption
+func (k *Keyring) Add(keyID string, key []byte) error {
+	if keyID == "" || len(keyID) > 255 {
+		return fmt.Errorf("invalid key id: '%s'", keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[keyID] = aead
+	return nil
+}
+
+// Rotate adds the key and makes it the current key. The previous keys are
+// kept for decryption until they are removed.
+func (k *Keyring) Rotate(keyID string, key []byte) error {
+	if err := k.Add(keyID, key); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.current = keyID
+	return nil
+}
+
+// Remove a key from the keyring. Entries encrypted with that key are then
+// considered as not found, so they get loaded again. The current key cannot
+// be removed.
+func (k *Keyring) Remove(keyID string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if keyID != k.current {
+		delete(k.keys, keyID)
+	}
+}
+
+func (k *Keyring) currentKey() (string, cipher.AEAD) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+func (k *Keyring) key(keyID string) (cipher.AEAD, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	aead, ok := k.keys[keyID]
+	return aead, ok
+}
+
+// NewEncryptedStore decorates a store so that the values are encrypted with
+// AES-GCM before reaching it. This is meant for remote stores (Redis for example)
+// holding sensitive data.
+//
+// Values are serialized to JSON, then encrypted with the current key of the keyring.
+// The id of the key is stored as a prefix of the entry, and the name of the group and
+// the key of the entry are used as associated data, so an entry cannot be moved to
+// another key without failing decryption.
+//
+// The optional interfaces of the store (Clearer, PrefixStore, TagStore, HealthChecker,
+// ConnectionNotifier) are forwarded. The groups must have a concrete value type.
+func NewEncryptedStore(store Store, keyring *Keyring) Store {
+	s := &encryptedStore{store: store, keyring: keyring, valueTypes: make(map[string]reflect.Type)}
+	// Clear and SetTags cannot report that the store does not support them
+	_, clearer := store.(Clearer)
+	_, tagStore := store.(TagStore)
+	switch {
+	case clearer && tagStore:
+		return encryptedClearerTagStore{s}
+	case clearer:
+		return encryptedClearer{s}
+	case tagStore:
+		return encryptedTagStore{s}
+	}
+	return s
+}
+
+type encryptedStore struct {
+	store   Store // Underlying store, only sees ciphertext
+	keyring *Keyring
+
+	valueTypesMu sync.RWMutex
+	valueTypes   map[string]reflect.Type
+}
+
+type encryptedClearer struct{ *encryptedStore }
+
+func (s encryptedClearer) Clear(groupName string) {
+	s.store.(Clearer).Clear(groupName)
+}
+
+type encryptedTagStore struct{ *encryptedStore }
+
+func (s encryptedTagStore) SetTags(key GroupKey, tags []string) error {
+	return s.store.(TagStore).SetTags(key, tags)
+}
+
+func (s encryptedTagStore) DelTag(groupName string, tag string) error {
+	return s.store.(TagStore).DelTag(groupName, tag)
+}
+
+type encryptedClearerTagStore struct{ *encryptedStore }
+
+func (s encryptedClearerTagStore) Clear(groupName string) {
+	encryptedClearer(s).Clear(groupName)
+}
+
+func (s encryptedClearerTagStore) SetTags(key GroupKey, tags []string) error {
+	return encryptedTagStore(s).SetTags(key, tags)
+}
+
+func (s encryptedClearerTagStore) DelTag(groupName string, tag string) error {
+	return encryptedTagStore(s).DelTag(groupName, tag)
+}
+
+// Panics if the value type is nil (group of an interface type), as the values
+// could not be decoded
+func (s *encryptedStore) ConfigureGroup(name string, config GroupConfig) {
+	if config.ValueType == nil {
+		panic(fmt.Sprintf("encrypted store: group %s has no value type, its values cannot be decrypted", name))
+	}
+	s.valueTypesMu.Lock()
+	s.valueTypes[name] = config.ValueType
+	s.valueTypesMu.Unlock()
+	config.ValueType = ciphertextType // Stored as an opaque string
+	s.store.ConfigureGroup(name, config)
+}
+
+func (s *encryptedStore) Get(key GroupKey) (any, error) {
+	v, err := s.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected type %T", ErrDecryptionFailed, v)
+	}
+	plaintext, err := s.open(key, []byte(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+
+	s.valueTypesMu.RLock()
+	valueType, ok := s.valueTypes[key.GroupName]
+	s.valueTypesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: group %s is not configured", ErrDecryptionFailed, key.GroupName)
+	}
+	value := reflect.New(valueType)
+	if err := json.Unmarshal(plaintext, value.Interface()); err != nil {
+		return nil, err
+	}
+	return value.Elem().Interface(), nil
+}
+
+func (s *encryptedStore) Set(key GroupKey, value any) error {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := s.seal(key, plaintext)
+	if err != nil {
+		return err
+	}
+	return s.store.Set(key, string(ciphertext))
+}
+
+func (s *encryptedStore) Del(key GroupKey) error {
+	return s.store.Del(key)
+}
+
+func (s *encryptedStore) Key(groupName string, key any) GroupKey {
+	return s.store.Key(groupName, key)
+}
+
+// Implement PrefixStore. Falls back to clearing the group, like the groups do.
+func (s *encryptedStore) DelPrefix(groupName string, prefix string) error {
+	return delPrefix(s.store, groupName, prefix)
+}
+
+// Implement HealthChecker. Healthy if the store does not know.
+func (s *encryptedStore) Healthy() bool {
+	if hc, ok := s.store.(HealthChecker); ok {
+		return hc.Healthy()
+	}
+	return true
+}
+
+// Implement ConnectionNotifier, if the store does
+func (s *encryptedStore) OnConnectionEvent(handler func(event ConnectionEvent)) io.Closer {
+	if cn, ok := s.store.(ConnectionNotifier); ok {
+		return cn.OnConnectionEvent(handler)
+	}
+	return noopCloser
+}
+
+// Layout of an entry: len(keyID) | keyID | nonce | ciphertext
+func (s *encryptedStore) seal(key GroupKey, plaintext []byte) ([]byte, error) {
+	keyID, aead := s.keyring.currentKey()
+	if aead == nil {
+		return nil, ErrNoEncryptionKey
+	}
+	out := make([]byte, 0, 1+len(keyID)+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	out = append(out, byte(len(keyID)))
+	out = append(out, keyID...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, associatedData(key)), nil
+}
+
+func (s *encryptedStore) open(key GroupKey, entry []byte) ([]byte, error) {
+	if len(entry) < 1 || len(entry) < 1+int(entry[0]) {
+		return nil, ErrDecryptionFailed
+	}
+	keyID := string(entry[1 : 1+entry[0]])
+	aead, ok := s.keyring.key(keyID)
+	if !ok {
+		// Key has been retired, the entry will be loaded again
+		return nil, ErrKeyNotFound
+	}
+	entry = entry[1+len(keyID):]
+	if len(entry) < aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	plaintext, err := aead.Open(nil, entry[:aead.NonceSize()], entry[aead.NonceSize():], associatedData(key))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+// Binds the ciphertext to the group and the key of the entry
+func associatedData(key GroupKey) []byte {
+	return []byte(fmt.Sprintf("%s\x00%v", key.GroupName, key.StoreKey))
+}
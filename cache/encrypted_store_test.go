@@ -0,0 +1,134 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type customer struct {
+	Name  string
+	Email string
+}
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 32)
+)
+
+func newTestEncryptedStore(t *testing.T) (Store, Store, *Keyring) {
+	keyring, err := NewKeyring("k1", key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := NewHashMapStore()
+	store := NewEncryptedStore(inner, keyring)
+	store.ConfigureGroup("customers", GroupConfig{ValueType: reflect.TypeOf(customer{})})
+	return store, inner, keyring
+}
+
+func TestEncryptedStore(t *testing.T) {
+	store, inner, _ := newTestEncryptedStore(t)
+	value := customer{Name: "Jane", Email: "jane@example.com"}
+	store.Set(store.Key("customers", "jane"), value)
+
+	raw, _ := inner.Get(inner.Key("customers", "jane"))
+	if strings.Contains(raw.(string), "jane@example.com") {
+		t.Errorf("value should not be stored in plaintext: %q", raw)
+	}
+	if !strings.HasPrefix(raw.(string), "\x02k1") {
+		t.Errorf("entry should be prefixed with the key id, got %q", raw)
+	}
+
+	v, err := store.Get(store.Key("customers", "jane"))
+	if err != nil || v != value {
+		t.Errorf("value for key should be '%v' but got '%v' (%v)", value, v, err)
+	}
+}
+
+func TestEncryptedStoreKeyRotation(t *testing.T) {
+	store, inner, keyring := newTestEncryptedStore(t)
+	value := customer{Name: "Jane"}
+	store.Set(store.Key("customers", "jane"), value)
+
+	keyring.Rotate("k2", key2)
+	if v, err := store.Get(store.Key("customers", "jane")); err != nil || v != value {
+		t.Errorf("entry encrypted with the old key should still be readable, got '%v' (%v)", v, err)
+	}
+
+	store.Set(store.Key("customers", "jane"), value) // Re-encrypted with the current key
+	raw, _ := inner.Get(inner.Key("customers", "jane"))
+	if !strings.HasPrefix(raw.(string), "\x02k2") {
+		t.Errorf("entry should be encrypted with the new key, got %q", raw)
+	}
+
+	store.Set(store.Key("customers", "john"), customer{Name: "John"})
+	keyring.Rotate("k3", key1)
+	keyring.Remove("k2")
+	if _, err := store.Get(store.Key("customers", "john")); err != ErrKeyNotFound {
+		t.Errorf("entry encrypted with a removed key should not be found, got %v", err)
+	}
+}
+
+func TestEncryptedStoreSwappedEntries(t *testing.T) {
+	store, inner, _ := newTestEncryptedStore(t)
+	store.Set(store.Key("customers", "jane"), customer{Name: "Jane"})
+
+	// Copy the ciphertext of one key to another key
+	raw, _ := inner.Get(inner.Key("customers", "jane"))
+	inner.Set(inner.Key("customers", "john"), raw)
+
+	if _, err := store.Get(store.Key("customers", "john")); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("swapped entry should fail decryption, got %v", err)
+	}
+}
+
+func TestEncryptedStoreForwardsInterfaces(t *testing.T) {
+	store, inner, _ := newTestEncryptedStore(t)
+	store.Set(store.Key("customers", "jane"), customer{Name: "Jane"})
+	store.Set(store.Key("customers", "john"), customer{Name: "John"})
+
+	if err := store.(PrefixStore).DelPrefix("customers", "ja"); err != nil {
+		t.Errorf("entries should be deleted by prefix: %v", err)
+	}
+	if _, err := inner.Get(inner.Key("customers", "jane")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("entry should be deleted, got %v", err)
+	}
+	store.(Clearer).Clear("customers")
+	if _, err := inner.Get(inner.Key("customers", "john")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("group should be cleared, got %v", err)
+	}
+	if _, ok := store.(TagStore); !ok {
+		t.Errorf("tags should be forwarded to the store")
+	}
+	if !store.(HealthChecker).Healthy() {
+		t.Errorf("store should be healthy")
+	}
+}
+
+func TestEncryptedStoreWithoutValueType(t *testing.T) {
+	store, _, _ := newTestEncryptedStore(t)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("group without value type should be rejected")
+		}
+	}()
+	store.ConfigureGroup("any", GroupConfig{})
+}
@@ -29,15 +29,21 @@ var (
 
 type Factory[K comparable, V any] struct {
 	Name                     string
-	CacheLoader              func(key K) (V, error) // Loader in case of cache miss
-	LoadDuplicateSuppression bool                   // To avoid multiple concurrent loads for the same entry
-	MessageBroker            MessageBroker          // Message broker for distributed cache flush messages
+	CacheLoader              func(key K) (V, error)           // Loader in case of cache miss
+	TaggedCacheLoader        func(key K) (V, []string, error) // Loader returning the tags of the entry
+	LoadDuplicateSuppression bool                             // To avoid multiple concurrent loads for the same entry
+	MessageBroker            MessageBroker                    // Message broker for distributed cache flush messages
 	Store                    Store
 	SecondLevelStore         Store
 	Ttl                      time.Duration // Time to live for a cache entry
+	SchemaVersion            string        // Version of the values in the second level store
+	autoSchemaVersion        bool          // Derive SchemaVersion from the type of the values
 	allowDuplicates          bool          // Allow duplicate names for testing of distributed functionality
 	debug                    bool          //
 	reloadOnDelete           bool          // Immediately reload on flush to avoid cache misses
+	schemaUpgrade            *schemaUpgrade[V]
+	recoveryAction           RecoveryAction
+	disconnectPolicy         DisconnectPolicy
 }
 
 func (f Factory[K, V]) Cache() *Group[K, V] {
@@ -45,7 +51,14 @@ func (f Factory[K, V]) Cache() *Group[K, V] {
 		panic("allowed characters in the name are: [a-zA-Z0-9_-]")
 	}
 
-	if f.CacheLoader == nil {
+	load := f.TaggedCacheLoader
+	if load == nil && f.CacheLoader != nil {
+		load = func(key K) (V, []string, error) {
+			v, err := f.CacheLoader(key)
+			return v, nil, err
+		}
+	}
+	if load == nil {
 		panic("no CacheLoader defined")
 	}
 	// Using default store unless another one is specified
@@ -73,9 +86,17 @@ func (f Factory[K, V]) Cache() *Group[K, V] {
 		messageBroker = defaultMessageBroker
 	}
 
+	schemaVersion := f.SchemaVersion
+	if f.autoSchemaVersion {
+		schemaVersion = schemaHash(reflect.TypeOf((*V)(nil)).Elem())
+	}
+
 	group := Group[K, V]{store: store, name: f.Name,
-		load: f.CacheLoader, messageBroker: messageBroker,
-		debug: f.debug, reloadOnDelete: f.reloadOnDelete, store2: f.SecondLevelStore}
+		load: load, messageBroker: messageBroker,
+		debug: f.debug, reloadOnDelete: f.reloadOnDelete, store2: f.SecondLevelStore,
+		name2: versionedName(f.Name, schemaVersion), schemaUpgrade: f.schemaUpgrade, node: newID(),
+		recoveryAction: f.recoveryAction, disconnectPolicy: f.disconnectPolicy}
+	group.tags.ttl, group.tags.exists = f.Ttl, group.inFirstLevel
 	if f.LoadDuplicateSuppression {
 		group.loadGroup = &singleflight.Group[K, V]{}
 	}
@@ -84,12 +105,29 @@ func (f Factory[K, V]) Cache() *Group[K, V] {
 	config := GroupConfig{Ttl: f.Ttl, Cost: 0, ValueType: reflect.TypeOf(*new(V))}
 	group.store.ConfigureGroup(f.Name, config)
 	if f.SecondLevelStore != nil {
-		group.store2.ConfigureGroup(f.Name, config)
+		group.store2.ConfigureGroup(group.name2, config)
+		if u := group.schemaUpgrade; u != nil {
+			if u.name == group.name2 {
+				panic("cannot upgrade from the current schema version")
+			}
+			oldConfig := config
+			oldConfig.ValueType = u.valueType
+			group.store2.ConfigureGroup(u.name, oldConfig)
+		}
 	}
 
 	if group.messageBroker != nil {
-		group.messageBroker.Subscribe(group.handleMessage)
+		group.outbox = outboxFor(group.messageBroker)
+		group.dispatcher = subscribe(group.messageBroker, group.name, &group)
+		if n, ok := group.messageBroker.(ConnectionNotifier); ok {
+			group.eventHandlers = append(group.eventHandlers, n.OnConnectionEvent(group.onConnectionEvent))
+		}
 	}
+	if n, ok := group.store2.(ConnectionNotifier); ok &&
+		(!isComparable(group.messageBroker) || any(group.store2) != any(group.messageBroker)) {
+		group.eventHandlers = append(group.eventHandlers, n.OnConnectionEvent(group.onSecondLevelEvent))
+	}
+	register(&group)
 
 	return &group
 }
@@ -125,6 +163,33 @@ func (f Factory[K, V]) WithSecondLevelStore(s Store) Factory[K, V] {
 	return f
 }
 
+// Version of the schema of the values stored in the second level store. Entries
+// written with another version are never returned, so nodes running different
+// versions of the application can share the second level store during a deployment.
+func (f Factory[K, V]) WithSchemaVersion(version string) Factory[K, V] {
+	f.SchemaVersion = version
+	f.autoSchemaVersion = false
+	return f
+}
+
+// Same as WithSchemaVersion, but the version is a hash of the type of the values
+// (field names, types and tags), so it changes whenever the type changes.
+func (f Factory[K, V]) WithAutoSchemaVersion() Factory[K, V] {
+	f.autoSchemaVersion = true
+	return f
+}
+
+// Migrate the entries written with a previous schema version instead of loading
+// them again. When an entry is not found in the second level store, the entry of
+// the previous version is read as oldValueType and converted with the upgrade
+// function. The result is then stored with the current version.
+func (f Factory[K, V]) WithSchemaUpgrade(fromVersion string, oldValueType reflect.Type,
+	upgrade func(old any) (V, error)) Factory[K, V] {
+	f.schemaUpgrade = &schemaUpgrade[V]{name: versionedName(f.Name, fromVersion),
+		valueType: oldValueType, upgrade: upgrade}
+	return f
+}
+
 // Use this option to print debug information
 func (f Factory[K, V]) WithDebug() Factory[K, V] {
 	f.debug = true
@@ -141,14 +206,30 @@ func (f Factory[K, V]) WithReloadOnDelete() Factory[K, V] {
 	return f
 }
 
+// Action to run when the group detects that it missed invalidation messages,
+// for example ClearOnRecovery. By default, only a warning is logged.
+func (f Factory[K, V]) WithRecovery(action RecoveryAction) Factory[K, V] {
+	f.recoveryAction = action
+	return f
+}
+
+// How the group reacts when its broker loses its connection. Only applies to
+// brokers that report their connection events (see ConnectionNotifier), and to
+// second level stores on reconnect.
+// By default, only a warning is logged.
+func (f Factory[K, V]) WithDisconnectPolicy(policy DisconnectPolicy) Factory[K, V] {
+	f.disconnectPolicy = policy
+	return f
+}
+
 func (f Factory[K, V]) WithTTL(ttl time.Duration) Factory[K, V] {
 	f.Ttl = ttl
 	return f
 }
 
-// Note: if you use the a broker for different cache groups, make sure that
-// the different groups are using different topics, so they do not receive
-// each others messages.
+// Message broker for distributed invalidation. Several groups can share a
+// broker and its topic: the broker is subscribed to once, and the messages
+// are dispatched to the groups by name.
 func (f Factory[K, V]) WithBroker(broker MessageBroker) Factory[K, V] {
 	f.MessageBroker = broker
 	return f
@@ -159,6 +240,12 @@ func NewFactory[K comparable, V any](name string, cacheLoader func(key K) (V, er
 	return Factory[K, V]{Name: name, CacheLoader: cacheLoader}
 }
 
+// Same as NewFactory, with a loader that returns the tags of each entry.
+// All the entries carrying a tag can then be deleted with InvalidateTag.
+func NewTaggedFactory[K comparable, V any](name string, cacheLoader func(key K) (V, []string, error)) Factory[K, V] {
+	return Factory[K, V]{Name: name, TaggedCacheLoader: cacheLoader}
+}
+
 func NewDecorator[K comparable, V any](name string) Factory[K, V] {
 	return Factory[K, V]{Name: name}
 }
@@ -16,15 +16,19 @@ limitations under the License.
 package cache
 
 import (
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
 )
 
 func NewHashMapStore() Store {
-	return &store{stores: make(map[string]*sync.Map)}
+	return &store{stores: make(map[string]*sync.Map), tags: make(map[string]*sync.Map)}
 }
 
 type store struct {
 	stores map[string]*sync.Map
+	tags   map[string]*sync.Map // Tags of the entries, by group
 }
 
 func (s *store) ConfigureGroup(name string, config GroupConfig) {
@@ -34,6 +38,7 @@ func (s *store) ConfigureGroup(name string, config GroupConfig) {
 		panic("hashmap store does not support Cost")
 	}
 	s.stores[name] = &sync.Map{}
+	s.tags[name] = &sync.Map{}
 }
 
 func (s *store) Get(key GroupKey) (any, error) {
@@ -50,11 +55,46 @@ func (s *store) Set(key GroupKey, value any) error {
 
 func (s *store) Del(key GroupKey) error {
 	s.stores[key.GroupName].Delete(key.StoreKey)
+	s.tags[key.GroupName].Delete(key.StoreKey)
 	return nil
 }
 
+// Empties the maps of the group, which may be read concurrently
 func (s *store) Clear(groupName string) {
-	s.stores[groupName] = &sync.Map{}
+	for _, m := range []*sync.Map{s.stores[groupName], s.tags[groupName]} {
+		if m == nil {
+			continue // Group not configured
+		}
+		m.Range(func(key, _ any) bool {
+			m.Delete(key)
+			return true
+		})
+	}
+}
+
+func (s *store) DelPrefix(groupName string, prefix string) error {
+	s.stores[groupName].Range(func(key, _ any) bool {
+		if k := reflect.ValueOf(key); k.Kind() == reflect.String && strings.HasPrefix(k.String(), prefix) {
+			s.Del(GroupKey{GroupName: groupName, StoreKey: key})
+		}
+		return true
+	})
+	return nil
+}
+
+func (s *store) SetTags(key GroupKey, tags []string) error {
+	s.tags[key.GroupName].Store(key.StoreKey, tags)
+	return nil
+}
+
+func (s *store) DelTag(groupName string, tag string) error {
+	s.tags[groupName].Range(func(key, tags any) bool {
+		if slices.Contains(tags.([]string), tag) {
+			s.Del(GroupKey{GroupName: groupName, StoreKey: key})
+		}
+		return true
+	})
+	return nil
 }
 
 func (s *store) Key(groupName string, key any) GroupKey {
@@ -0,0 +1,177 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Invalidator sends invalidation messages to the groups of the other nodes,
+// without loading nor caching anything. It is meant for processes that change
+// the data behind the caches, like CDC pipelines or admin jobs.
+//
+// Keys must have the type of the keys of the group, as they are decoded by the
+// receiving groups.
+type Invalidator struct {
+	broker         MessageBroker
+	codec          MessageCodec
+	store2         Store
+	schemaVersions []string
+	node           string
+
+	mu        sync.Mutex
+	sequences map[string]*sequences // By group, as the receivers check them by group
+}
+
+// NewInvalidator creates an invalidator sending through the broker, with the
+// codec set for the broker (see SetMessageCodec)
+func NewInvalidator(broker MessageBroker) *Invalidator {
+	outboxesMu.Lock()
+	codec := codecFor(broker)
+	outboxesMu.Unlock()
+	return &Invalidator{broker: broker, codec: codec, node: newID(), sequences: make(map[string]*sequences)}
+}
+
+// WithCodec sends the messages with the codec instead of the one set for the
+// broker. The codec must be registered on the receiving nodes (see
+// RegisterMessageCodec).
+func (i *Invalidator) WithCodec(codec MessageCodec) *Invalidator {
+	i.codec = codec
+	return i
+}
+
+// WithSecondLevelStore deletes the entries from the second level store as well.
+// Entries are deleted for each of the schema versions, the entries of groups
+// without schema version are deleted if none is given.
+func (i *Invalidator) WithSecondLevelStore(store Store, schemaVersions ...string) *Invalidator {
+	i.store2 = store
+	i.schemaVersions = schemaVersions
+	if len(i.schemaVersions) == 0 {
+		i.schemaVersions = []string{""}
+	}
+	return i
+}
+
+// Del deletes the keys from the group, on all the nodes
+func (i *Invalidator) Del(group string, keys ...any) error {
+	cm := i.message(msgDel, group)
+	for _, key := range keys {
+		k, err := i.codec.EncodeKey(key)
+		if err != nil {
+			return fmt.Errorf("cannot encode key %v: %w", key, err)
+		}
+		cm.Keys = append(cm.Keys, k)
+	}
+	if len(cm.Keys) == 1 {
+		cm.Key, cm.Keys = cm.Keys[0], nil
+	}
+
+	var errs []error
+	for _, name := range i.secondLevelNames(group) {
+		for _, key := range keys {
+			if err := i.store2.Del(i.store2.Key(name, key)); err != nil {
+				errs = append(errs, fmt.Errorf("cannot delete key %v from second level store: %w", key, err))
+			}
+		}
+	}
+	if i.codec == JSONCodec && len(cm.Keys) > 1 { // Legacy receivers only read the key of the messages
+		for _, k := range cm.Keys {
+			m := i.message(msgDel, group)
+			m.Key = k
+			errs = append(errs, i.send(m))
+		}
+		return errors.Join(errs...)
+	}
+	return errors.Join(append(errs, i.send(cm))...)
+}
+
+// Clear deletes all the entries of the group, on all the nodes
+func (i *Invalidator) Clear(group string) error {
+	var errs []error
+	for _, name := range i.secondLevelNames(group) {
+		if c, ok := i.store2.(Clearer); ok {
+			c.Clear(name)
+		} else {
+			errs = append(errs, fmt.Errorf("%w: second level store cannot be cleared", ErrNotSupported))
+		}
+	}
+	return errors.Join(append(errs, i.send(i.message(msgClear, group)))...)
+}
+
+// InvalidateTag deletes the entries carrying the tag in the groups, on all
+// the nodes. Without groups, the entries are deleted from all the groups, but
+// the second level store is not changed.
+func (i *Invalidator) InvalidateTag(tag string, groups ...string) error {
+	if len(groups) == 0 {
+		cm := i.message(msgTag, "") // Not sequenced, as received by all the groups
+		cm.Tag = tag
+		return i.send(cm)
+	}
+
+	var errs []error
+	for _, group := range groups {
+		for _, name := range i.secondLevelNames(group) {
+			if ts, ok := i.store2.(TagStore); ok {
+				if err := ts.DelTag(name, tag); err != nil {
+					errs = append(errs, fmt.Errorf("cannot delete tag %s from second level store: %w", tag, err))
+				}
+			}
+		}
+		cm := i.message(msgTag, group)
+		cm.Tag = tag
+		errs = append(errs, i.send(cm))
+	}
+	return errors.Join(errs...)
+}
+
+func (i *Invalidator) message(t MessageType, group string) *Message {
+	return newMessage(t, group, i.node)
+}
+
+func (i *Invalidator) send(cm *Message) error {
+	var msg []byte
+	var err error
+	if cm.Group != "" {
+		i.mu.Lock()
+		s, ok := i.sequences[cm.Group]
+		if !ok {
+			s = &sequences{}
+			i.sequences[cm.Group] = s
+		}
+		i.mu.Unlock()
+		msg, err = s.encode(cm, i.codec)
+	} else {
+		msg, err = i.codec.Encode(cm)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot encode %s message: %w", cm.Type, err)
+	}
+	return i.broker.Send(msg)
+}
+
+// Names of the group in the second level store
+func (i *Invalidator) secondLevelNames(group string) []string {
+	if i.store2 == nil {
+		return nil
+	}
+	names := make([]string, len(i.schemaVersions))
+	for j, v := range i.schemaVersions {
+		names[j] = versionedName(group, v)
+	}
+	return names
+}
@@ -0,0 +1,166 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrBrokerClosed = errors.New("broker closed")
+
+// What a MemoryBroker does when the buffer of a subscriber is full
+type OverflowPolicy int
+
+const (
+	OverflowBlock OverflowPolicy = iota // Send waits until there is room in the buffer
+	OverflowDrop                        // The message is dropped for that subscriber
+)
+
+type MemoryBrokerConfig struct {
+	BufferSize int // Number of messages buffered per subscriber
+	Overflow   OverflowPolicy
+}
+
+var DefaultMemoryBrokerConfig = MemoryBrokerConfig{BufferSize: 1024, Overflow: OverflowBlock}
+
+// MemoryBroker is a MessageBroker delivering the messages within the process.
+// It can be used to run several cache "nodes" in the same process (for example
+// in a modular monolith) and for testing.
+//
+// Each subscriber receives the messages in the order they were sent, from its own
+// goroutine. With the OverflowBlock policy, a handler sending messages through the same
+// broker can block if its buffer is full.
+type MemoryBroker struct {
+	config MemoryBrokerConfig
+
+	mu          sync.RWMutex
+	subscribers map[uint64]*memorySubscriber
+	nextID      uint64
+	closed      bool
+
+	dropped atomic.Uint64
+}
+
+type memorySubscriber struct {
+	messages chan []byte
+	done     chan struct{} // Closed when unsubscribed
+	once     sync.Once
+}
+
+func NewMemoryBroker(config MemoryBrokerConfig) *MemoryBroker {
+	if config.BufferSize <= 0 {
+		config.BufferSize = DefaultMemoryBrokerConfig.BufferSize
+	}
+	return &MemoryBroker{config: config, subscribers: make(map[uint64]*memorySubscriber)}
+}
+
+// Implement MessageBroker
+func (b *MemoryBroker) Send(msg []byte) error {
+	msg = append([]byte(nil), msg...) // The caller can reuse its buffer
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBrokerClosed
+	}
+	for _, s := range b.subscribers {
+		if b.config.Overflow == OverflowDrop {
+			select {
+			case s.messages <- msg:
+			default:
+				b.dropped.Add(1)
+			}
+			continue
+		}
+		select {
+		case s.messages <- msg:
+		case <-s.done: // Unsubscribed while waiting
+		}
+	}
+	return nil
+}
+
+// Implement MessageBroker
+func (b *MemoryBroker) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	s := &memorySubscriber{messages: make(chan []byte, b.config.BufferSize), done: make(chan struct{})}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, ErrBrokerClosed
+	}
+	id := b.nextID
+	b.nextID++
+	b.subscribers[id] = s
+	b.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case msg := <-s.messages:
+				handler(msg)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+
+	var cf closerFunc = func() error {
+		s.stop() // First, so that blocked senders release the lock
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+		return nil
+	}
+	return cf, nil
+}
+
+// Close unsubscribes all the subscribers. Messages cannot be sent anymore.
+func (b *MemoryBroker) Close() error {
+	b.mu.RLock()
+	for _, s := range b.subscribers {
+		s.stop()
+	}
+	b.mu.RUnlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.subscribers = make(map[uint64]*memorySubscriber)
+	return nil
+}
+
+// Dropped returns the number of messages dropped because the buffer of a
+// subscriber was full (OverflowDrop policy)
+func (b *MemoryBroker) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+func (s *memorySubscriber) stop() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// To be able to return an anonymous function in Subscribe()
+type closerFunc func() error
+
+// Closer that does nothing
+var noopCloser io.Closer = closerFunc(func() error { return nil })
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryBrokerOrder(t *testing.T) {
+	broker := NewMemoryBroker(MemoryBrokerConfig{BufferSize: 4})
+	var received [2][]string
+	var wg sync.WaitGroup
+	wg.Add(2 * 100)
+	for i := range received {
+		i := i
+		broker.Subscribe(func(msg []byte) {
+			received[i] = append(received[i], string(msg))
+			wg.Done()
+		})
+	}
+
+	for i := 0; i < 100; i++ {
+		broker.Send([]byte(fmt.Sprint(i)))
+	}
+	wg.Wait()
+
+	for i := range received {
+		for j, msg := range received[i] {
+			if msg != fmt.Sprint(j) {
+				t.Fatalf("subscriber %d: message %d should be '%d', got '%s'", i, j, j, msg)
+			}
+		}
+	}
+}
+
+func TestMemoryBrokerDrop(t *testing.T) {
+	broker := NewMemoryBroker(MemoryBrokerConfig{BufferSize: 1, Overflow: OverflowDrop})
+	block := make(chan bool)
+	broker.Subscribe(func(msg []byte) {
+		<-block
+	})
+
+	for i := 0; i < 10; i++ {
+		if err := broker.Send([]byte("msg")); err != nil {
+			t.Error(err)
+		}
+	}
+	close(block)
+
+	if dropped := broker.Dropped(); dropped < 8 {
+		t.Errorf("at least 8 messages should be dropped, got %d", dropped)
+	}
+}
+
+func TestMemoryBrokerUnsubscribe(t *testing.T) {
+	broker := NewMemoryBroker(MemoryBrokerConfig{BufferSize: 1})
+	var mu sync.Mutex
+	received := map[string]int{}
+	subscriber := func(name string) func(msg []byte) {
+		return func(msg []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			received[name]++
+		}
+	}
+	closer1, _ := broker.Subscribe(subscriber("first"))
+	broker.Subscribe(subscriber("second"))
+	blocked, _ := broker.Subscribe(func(msg []byte) { select {} }) // Never reads
+
+	broker.Send([]byte("1"))
+	broker.Send([]byte("2")) // Buffer of the blocked subscriber is full
+	done := make(chan bool)
+	go func() {
+		broker.Send([]byte("3")) // Blocked until unsubscribed
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	blocked.Close()
+	<-done
+
+	closer1.Close()
+	broker.Send([]byte("4"))
+	time.Sleep(10 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if received["first"] != 3 || received["second"] != 4 {
+		t.Errorf("first subscriber should receive 3 messages and second 4, got %v", received)
+	}
+}
+
+func TestMemoryBrokerClose(t *testing.T) {
+	broker := NewMemoryBroker(DefaultMemoryBrokerConfig)
+	broker.Subscribe(func(msg []byte) {})
+	broker.Close()
+	if err := broker.Send([]byte("msg")); err != ErrBrokerClosed {
+		t.Errorf("send should fail after close, got %v", err)
+	}
+}
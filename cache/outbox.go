@@ -0,0 +1,276 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+)
+
+// BatchConfig defines how the messages sent through a broker are batched.
+// Keys deleted by a group while the previous messages are being sent are
+// coalesced into a single message, and duplicate keys are sent once.
+type BatchConfig struct {
+	Window     time.Duration // Time to wait for more keys before sending. With 0, messages are sent as soon as possible
+	MaxKeys    int           // Maximum number of keys per message
+	MaxBytes   int           // Maximum size of the keys of a message, for brokers limiting the size of the messages. Unlimited with 0
+	MaxPending int           // Calls to Del block when that many keys are waiting to be sent
+}
+
+var (
+	DefaultBatchConfig = BatchConfig{MaxKeys: 1000, MaxPending: 100_000}
+
+	// One outbox per broker
+	outboxes     = map[MessageBroker]*outbox{}
+	batchConfigs = map[MessageBroker]BatchConfig{}
+	outboxesMu   sync.Mutex
+)
+
+// SetBatchConfig configures the batching of the messages sent through the broker.
+// Only applies if called before the first group using the broker is created.
+func SetBatchConfig(broker MessageBroker, config BatchConfig) {
+	if !isComparable(broker) {
+		log.Printf("Warn - batch config ignored, broker %T is not comparable", broker)
+		return
+	}
+	outboxesMu.Lock()
+	defer outboxesMu.Unlock()
+	batchConfigs[broker] = config
+}
+
+// ReleaseBroker sends the pending messages of the broker, closes its subscription
+// and forgets its settings (see SetBatchConfig and SetMessageCodec). The groups
+// using the broker do not send nor receive messages anymore.
+func ReleaseBroker(broker MessageBroker) {
+	if !isComparable(broker) {
+		return // Nothing is kept for the broker
+	}
+	outboxesMu.Lock()
+	o := outboxes[broker]
+	delete(outboxes, broker)
+	delete(batchConfigs, broker)
+	delete(codecs, broker)
+	outboxesMu.Unlock()
+	if o != nil {
+		o.close()
+	}
+
+	dispatchersMu.Lock()
+	d := dispatchers[broker]
+	delete(dispatchers, broker)
+	dispatchersMu.Unlock()
+	if d != nil {
+		d.close()
+	}
+}
+
+// Whether the broker can be a key of the maps. A broker that is not comparable
+// (a struct holding a func or a map, for example) makes the lookups panic: each
+// group using it then has its own outbox and subscription, with the defaults.
+func isComparable(broker MessageBroker) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return broker == broker
+}
+
+// Outbox of the broker, created on first use. Must be released by the group.
+func outboxFor(broker MessageBroker) *outbox {
+	comparable := isComparable(broker)
+	outboxesMu.Lock()
+	defer outboxesMu.Unlock()
+	if !comparable {
+		o := newOutbox(broker, DefaultBatchConfig, DefaultMessageCodec)
+		o.refs++
+		return o
+	}
+	o, ok := outboxes[broker]
+	if !ok {
+		config, ok := batchConfigs[broker]
+		if !ok {
+			config = DefaultBatchConfig
+		}
+		o = newOutbox(broker, config, codecFor(broker))
+		outboxes[broker] = o
+	}
+	o.refs++
+	return o
+}
+
+// Releases the outbox for a group, which is closed once no group uses it
+func (o *outbox) release() {
+	outboxesMu.Lock()
+	o.refs--
+	last := o.refs == 0
+	if last && isComparable(o.broker) && outboxes[o.broker] == o {
+		delete(outboxes, o.broker)
+	}
+	outboxesMu.Unlock()
+	if last {
+		o.close()
+	}
+}
+
+func newOutbox(broker MessageBroker, config BatchConfig, codec MessageCodec) *outbox {
+	if codec == JSONCodec {
+		config.MaxKeys = 1 // Legacy receivers only read the key of the messages
+	}
+	o := &outbox{broker: broker, config: config, codec: codec, last: make(map[*sequences]*batch),
+		stop: make(chan struct{}), done: make(chan struct{})}
+	o.cond = sync.NewCond(&o.mu)
+	go o.run()
+	return o
+}
+
+// Queue of the messages to send through a broker, sent by a single goroutine
+type outbox struct {
+	broker MessageBroker
+	config BatchConfig
+	codec  MessageCodec
+	refs   int // Groups using the outbox, guarded by outboxesMu
+
+	mu      sync.Mutex
+	cond    *sync.Cond            // Signals changes of pending
+	pending []*batch              // In the order of the calls
+	last    map[*sequences]*batch // Last pending batch of each sender
+	size    int                   // Number of keys and messages pending
+	closed  bool
+	stop    chan struct{} // Closed by close
+	done    chan struct{} // Closed when run returns
+}
+
+// A message, and the keys added to it
+type batch struct {
+	cm     *Message
+	keys   [][]byte
+	bytes  int                 // Size of the keys, with their framing
+	seen   map[string]struct{} // To send keys once
+	sender *sequences
+	warn   func(message string, args ...any)
+}
+
+// Adds a message to the queue. When key is not nil, the message is merged with
+// the previous message of the sender if it has the same type.
+func (o *outbox) enqueue(cm *Message, key []byte, sender *sequences, warn func(string, ...any)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for o.config.MaxPending > 0 && o.size >= o.config.MaxPending && !o.closed {
+		o.cond.Wait() // Backpressure
+	}
+	if o.closed {
+		warn("cannot send %s message: broker released", cm.Type)
+		return
+	}
+	if b := o.last[sender]; key != nil && b != nil && b.cm.Type == cm.Type && b.keys != nil {
+		if _, ok := b.seen[string(key)]; ok {
+			return
+		}
+		if (o.config.MaxKeys <= 0 || len(b.keys) < o.config.MaxKeys) &&
+			(o.config.MaxBytes <= 0 || b.bytes+keySize(key) <= o.config.MaxBytes) {
+			b.keys = append(b.keys, key)
+			b.bytes += keySize(key)
+			b.seen[string(key)] = struct{}{}
+			o.size++
+			return
+		}
+	}
+
+	b := &batch{cm: cm, sender: sender, warn: warn}
+	if key != nil {
+		b.keys = [][]byte{key}
+		b.bytes = keySize(key)
+		b.seen = map[string]struct{}{string(key): {}}
+	}
+	o.pending = append(o.pending, b)
+	o.last[sender] = b
+	o.size++
+	o.cond.Broadcast()
+}
+
+// Size of a key in a message, counting its framing (length or separator)
+func keySize(key []byte) int {
+	return len(key) + binary.MaxVarintLen32
+}
+
+// Stops the outbox, once the pending messages are sent
+func (o *outbox) close() {
+	o.mu.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.stop)
+	}
+	o.cond.Broadcast()
+	o.mu.Unlock()
+	<-o.done
+}
+
+func (o *outbox) run() {
+	defer close(o.done)
+	for {
+		o.mu.Lock()
+		for len(o.pending) == 0 && !o.closed {
+			o.cond.Wait()
+		}
+		if len(o.pending) == 0 {
+			o.mu.Unlock()
+			return // Closed
+		}
+		o.mu.Unlock()
+
+		if o.config.Window > 0 {
+			select { // Wait for more keys
+			case <-time.After(o.config.Window):
+			case <-o.stop:
+			}
+		}
+
+		o.mu.Lock()
+		batches := o.pending
+		o.pending = nil
+		clear(o.last)
+		o.size = 0
+		o.cond.Broadcast() // Wakes up blocked senders
+		o.mu.Unlock()
+
+		for _, b := range batches {
+			o.send(b)
+		}
+	}
+}
+
+func (o *outbox) send(b *batch) {
+	cm := b.cm
+	if len(b.keys) == 1 {
+		cm.Key = b.keys[0]
+	} else if len(b.keys) > 1 {
+		cm.Keys = b.keys
+	}
+	// Sequence numbers are assigned in the order of the calls to the broker,
+	// so that receivers see them increasing
+	msg, err := b.sender.encode(cm, o.codec)
+	if err != nil {
+		b.warn("cannot send %s message: %v", cm.Type, err)
+		return
+	}
+	if err := o.broker.Send(msg); err != nil {
+		// Counts as a missed message for receivers
+		b.warn("cannot send %s message %s: %v", cm.Type, cm.ID, err)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Broker recording the messages sent, and delivering them to its subscribers
+type recordingBroker struct {
+	mu       sync.Mutex
+	sent     [][]byte
+	handlers []func(msg []byte)
+	delay    time.Duration // Slow broker
+	closer   io.Closer     // Of the subscriptions
+}
+
+func (b *recordingBroker) Send(msg []byte) error {
+	time.Sleep(b.delay)
+	b.mu.Lock()
+	b.sent = append(b.sent, msg)
+	handlers := b.handlers
+	b.mu.Unlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+	return nil
+}
+
+func (b *recordingBroker) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+	return b.closer, nil
+}
+
+func (b *recordingBroker) messages() []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var messages []*Message
+	for _, msg := range b.sent {
+		cm, _ := decodeMessage(msg)
+		messages = append(messages, cm)
+	}
+	return messages
+}
+
+func TestBatching(t *testing.T) {
+	broker := &recordingBroker{}
+	SetBatchConfig(broker, BatchConfig{Window: 20 * time.Millisecond, MaxKeys: 100})
+	loader := func(key string) (string, error) {
+		return key, nil
+	}
+	sender := NewFactory("TestBatching", loader).WithStore(NewHashMapStore()).WithBroker(broker).Cache()
+	counter := 0
+	receiver := NewFactory("TestBatching", func(key string) (int, error) {
+		counter++
+		return counter, nil
+	}).WithStore(NewHashMapStore()).WithBroker(broker).AllowDuplicates().Cache() // Same group on another node
+
+	for i := 0; i < 150; i++ {
+		receiver.Get(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < 150; i++ {
+		sender.Del(fmt.Sprintf("key%d", i))
+		sender.Del(fmt.Sprintf("key%d", i)) // Duplicate
+	}
+	time.Sleep(50 * time.Millisecond) // Wait for the window
+
+	messages := broker.messages()
+	if len(messages) != 2 {
+		t.Fatalf("keys should be sent in 2 messages, got %d", len(messages))
+	}
+	if len(messages[0].Keys) != 100 || len(messages[1].Keys) != 50 {
+		t.Errorf("messages should have 100 and 50 keys, got %d and %d", len(messages[0].Keys), len(messages[1].Keys))
+	}
+	if messages[0].Seq != 1 || messages[1].Seq != 2 {
+		t.Errorf("messages should be sequenced, got %d and %d", messages[0].Seq, messages[1].Seq)
+	}
+	if v, _ := receiver.Get("key149"); v != 151 || counter != 151 {
+		t.Errorf("batched keys should have been deleted, got %v", v)
+	}
+}
+
+func TestBatchingBackpressure(t *testing.T) {
+	broker := &recordingBroker{delay: 10 * time.Millisecond}
+	SetBatchConfig(broker, BatchConfig{MaxKeys: 10, MaxPending: 10})
+	loader := func(key int) (int, error) {
+		return key, nil
+	}
+	g := NewFactory("TestBatchingBackpressure", loader).WithStore(NewHashMapStore()).WithBroker(broker).Cache()
+
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		g.Del(i)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Errorf("Del should block while the queue is full")
+	}
+}
+
+// Broker that is not comparable, as it holds a func
+type funcBroker struct {
+	send func(msg []byte) error
+}
+
+func (b funcBroker) Send(msg []byte) error {
+	return b.send(msg)
+}
+
+func (b funcBroker) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	return nil, nil
+}
+
+func TestReleaseBroker(t *testing.T) {
+	broker := &recordingBroker{}
+	closed := false
+	broker.closer = closerFunc(func() error {
+		closed = true
+		return nil
+	})
+	SetBatchConfig(broker, BatchConfig{Window: time.Hour})
+	loader := func(key string) (string, error) {
+		return key, nil
+	}
+	g := NewFactory("TestReleaseBroker", loader).WithStore(NewHashMapStore()).WithBroker(broker).Cache()
+	g.Del("key")
+
+	ReleaseBroker(broker)
+	if len(broker.messages()) != 1 {
+		t.Errorf("pending message should be sent")
+	}
+	if !closed {
+		t.Errorf("subscription should be closed")
+	}
+	outboxesMu.Lock()
+	_, configured := batchConfigs[broker]
+	_, ok := outboxes[broker]
+	outboxesMu.Unlock()
+	dispatchersMu.Lock()
+	_, subscribed := dispatchers[broker]
+	dispatchersMu.Unlock()
+	if configured || ok || subscribed {
+		t.Errorf("broker should be forgotten")
+	}
+}
+
+func TestNotComparableBroker(t *testing.T) {
+	sent := make(chan []byte, 1)
+	broker := funcBroker{send: func(msg []byte) error {
+		sent <- msg
+		return nil
+	}}
+	SetBatchConfig(broker, DefaultBatchConfig) // Ignored
+	loader := func(key string) (string, error) {
+		return key, nil
+	}
+	g := NewFactory("TestNotComparableBroker", loader).WithStore(NewHashMapStore()).WithBroker(broker).Cache()
+	g.Del("key")
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Errorf("message should be sent")
+	}
+	ReleaseBroker(broker)
+}
+
+func TestBatchingLegacyReceivers(t *testing.T) {
+	broker := &recordingBroker{}
+	SetMessageCodec(broker, JSONCodec)
+	SetBatchConfig(broker, BatchConfig{Window: 20 * time.Millisecond, MaxKeys: 100})
+	loader := func(key string) (string, error) {
+		return key, nil
+	}
+	g := NewFactory("TestBatchingLegacyReceivers", loader).WithStore(NewHashMapStore()).WithBroker(broker).Cache()
+	for i := 0; i < 3; i++ {
+		g.Del(fmt.Sprintf("key%d", i))
+	}
+	time.Sleep(50 * time.Millisecond) // Wait for the window
+
+	if len(broker.sent) != 3 {
+		t.Fatalf("keys should be sent in 3 messages, got %d", len(broker.sent))
+	}
+	for i, msg := range broker.sent {
+		var legacy struct { // As decoded by the nodes of previous versions
+			Group string `json:"group"`
+			Key   string `json:"key"`
+		}
+		if err := json.Unmarshal(msg, &legacy); err != nil || legacy.Key != fmt.Sprintf("key%d", i) {
+			t.Errorf("message should hold key%d for legacy receivers, got %s (%v)", i, msg, err)
+		}
+	}
+}
+
+func TestBatchingMaxBytes(t *testing.T) {
+	broker := &recordingBroker{}
+	SetBatchConfig(broker, BatchConfig{Window: 20 * time.Millisecond, MaxBytes: 1000})
+	loader := func(key string) (string, error) {
+		return key, nil
+	}
+	g := NewFactory("TestBatchingMaxBytes", loader).WithStore(NewHashMapStore()).WithBroker(broker).Cache()
+	for i := 0; i < 100; i++ {
+		g.Del(fmt.Sprintf("key%02d", i))
+	}
+	time.Sleep(50 * time.Millisecond) // Wait for the window
+
+	messages := broker.messages()
+	if len(messages) < 2 {
+		t.Fatalf("keys should be split over several messages, got %d", len(messages))
+	}
+	keys := 0
+	for _, m := range messages {
+		size := 0
+		for _, k := range m.Keys {
+			size += keySize(k)
+		}
+		if size > 1000 {
+			t.Errorf("keys of a message should be at most 1000 bytes, got %d", size)
+		}
+		keys += len(m.Keys)
+	}
+	if keys != 100 {
+		t.Errorf("all the keys should be sent, got %d", keys)
+	}
+}
@@ -0,0 +1,547 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package peerbroker provides a cache.MessageBroker sending the messages
+// directly to the other nodes of the cluster, using only the standard library.
+//
+// Messages are either sent to every peer over TCP, or to a UDP multicast group.
+// They are signed with a shared secret, and messages with an invalid signature
+// are dropped.
+package peerbroker
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"sustainyfacts.dev/anycache/cache"
+)
+
+var (
+	ErrNoSecret       = errors.New("peerbroker: a shared secret is required")
+	ErrClosed         = errors.New("peerbroker: broker closed")
+	ErrMessageTooLong = errors.New("peerbroker: message too long")
+)
+
+const (
+	macSize = sha256.Size
+
+	// Maximum size of a message over TCP. Frames are allocated before their
+	// signature is checked, so it limits what an unauthenticated peer can allocate.
+	maxMessageSize = 1 << 20
+
+	// Maximum size of a message over UDP, so that datagrams are not truncated
+	maxDatagramSize = 65507 - macSize
+
+	// Room left for the other fields of a batch of keys (see cache.BatchConfig)
+	batchOverhead = 4096
+)
+
+// Resolver returns the addresses ("host:port") of the peers
+type Resolver interface {
+	Peers(ctx context.Context) ([]string, error)
+}
+
+// ResolverFunc is a function implementing Resolver
+type ResolverFunc func(ctx context.Context) ([]string, error)
+
+func (f ResolverFunc) Peers(ctx context.Context) ([]string, error) {
+	return f(ctx)
+}
+
+// Static returns a resolver always returning the same peers
+func Static(addrs ...string) Resolver {
+	return ResolverFunc(func(ctx context.Context) ([]string, error) {
+		return addrs, nil
+	})
+}
+
+// DNS returns a resolver looking up the addresses of a host name, for example
+// a headless service in Kubernetes. All the peers listen on the same port.
+func DNS(host string, port int) Resolver {
+	return ResolverFunc(func(ctx context.Context) ([]string, error) {
+		ips, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, len(ips))
+		for i, ip := range ips {
+			addrs[i] = net.JoinHostPort(ip, strconv.Itoa(port))
+		}
+		return addrs, nil
+	})
+}
+
+type Config struct {
+	Secret []byte // Shared by all the nodes, used to sign the messages
+
+	// TCP fan-out
+	Listen          string        // Address to listen on, for example ":7946"
+	Peers           Resolver      // Addresses of the other nodes. Its own address is ignored
+	RefreshInterval time.Duration // How often the peers are resolved again. With 0, only at startup
+	ReconnectDelay  time.Duration // Delay before reconnecting to a peer
+	QueueSize       int           // Number of messages queued per peer. Messages are dropped when full
+
+	// UDP multicast, instead of TCP
+	Multicast string // Multicast group, for example "239.1.2.3:7947"
+	Interface string // Name of the network interface for multicast. Default is chosen by the system
+}
+
+var DefaultConfig = Config{
+	Listen:          ":7946",
+	RefreshInterval: 30 * time.Second,
+	ReconnectDelay:  time.Second,
+	QueueSize:       1024,
+}
+
+// Broker is a cache.MessageBroker connecting the nodes directly to each other
+type Broker struct {
+	config Config
+
+	listener  net.Listener // TCP
+	multicast *net.UDPConn // Receives the datagrams of the multicast group
+	sender    *net.UDPConn // Sends datagrams to the multicast group
+
+	mu       sync.Mutex
+	peers    map[string]*peer
+	conns    map[net.Conn]struct{} // Accepted connections
+	handlers map[uint64]func(msg []byte)
+	nextID   uint64
+	closed   bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var _ cache.MessageBroker = (*Broker)(nil)
+
+// New starts a broker. With a multicast group, messages are sent over UDP,
+// otherwise it listens for TCP connections and connects to the peers.
+//
+// The batches of keys are limited so that they fit in a message (see
+// cache.SetBatchConfig, whose MaxBytes must stay below that limit if changed).
+func New(config Config) (*Broker, error) {
+	if len(config.Secret) == 0 {
+		return nil, ErrNoSecret
+	}
+	if config.ReconnectDelay <= 0 {
+		config.ReconnectDelay = DefaultConfig.ReconnectDelay
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultConfig.QueueSize
+	}
+	b := &Broker{
+		config:   config,
+		peers:    make(map[string]*peer),
+		conns:    make(map[net.Conn]struct{}),
+		handlers: make(map[uint64]func(msg []byte)),
+		done:     make(chan struct{}),
+	}
+	var err error
+	if config.Multicast != "" {
+		err = b.startMulticast()
+	} else {
+		err = b.startTCP()
+	}
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	batchConfig := cache.DefaultBatchConfig
+	batchConfig.MaxBytes = maxMessageSize - batchOverhead
+	if b.sender != nil {
+		batchConfig.MaxBytes = maxDatagramSize - batchOverhead
+	}
+	cache.SetBatchConfig(b, batchConfig)
+	return b, nil
+}
+
+// Addr returns the address the broker listens on
+func (b *Broker) Addr() net.Addr {
+	if b.multicast != nil {
+		return b.multicast.LocalAddr()
+	}
+	return b.listener.Addr()
+}
+
+// Implement cache.MessageBroker
+func (b *Broker) Send(msg []byte) error {
+	if b.sender != nil {
+		if len(msg) > maxDatagramSize {
+			return ErrMessageTooLong
+		}
+		_, err := b.sender.Write(b.sign(msg))
+		return err
+	}
+
+	if len(msg) > maxMessageSize {
+		return ErrMessageTooLong
+	}
+	frame := make([]byte, 4, 4+macSize+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(macSize+len(msg)))
+	frame = append(frame, b.sign(msg)...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	for _, p := range b.peers {
+		select {
+		case p.queue <- frame:
+		default:
+			log.Printf("Warn - peerbroker: queue of peer %s is full, message dropped", p.addr)
+		}
+	}
+	return nil
+}
+
+// Implement cache.MessageBroker
+func (b *Broker) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+	return closerFunc(func() error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+		return nil
+	}), nil
+}
+
+// Close stops listening and closes the connections to the peers
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	if b.multicast != nil {
+		b.multicast.Close()
+	}
+	if b.sender != nil {
+		b.sender.Close()
+	}
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return nil
+}
+
+// Returns the message prefixed with its signature
+func (b *Broker) sign(msg []byte) []byte {
+	mac := hmac.New(sha256.New, b.config.Secret)
+	mac.Write(msg)
+	return append(mac.Sum(make([]byte, 0, macSize+len(msg))), msg...)
+}
+
+// Checks the signature and delivers the message to the handlers
+func (b *Broker) receive(signed []byte, from net.Addr) {
+	if len(signed) < macSize {
+		log.Printf("Warn - peerbroker: message from %v too short", from)
+		return
+	}
+	msg := signed[macSize:]
+	mac := hmac.New(sha256.New, b.config.Secret)
+	mac.Write(msg)
+	if !hmac.Equal(mac.Sum(nil), signed[:macSize]) {
+		log.Printf("Warn - peerbroker: message from %v with invalid signature dropped", from)
+		return
+	}
+
+	b.mu.Lock()
+	handlers := make([]func(msg []byte), 0, len(b.handlers))
+	for _, h := range b.handlers {
+		handlers = append(handlers, h)
+	}
+	b.mu.Unlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+}
+
+func (b *Broker) startMulticast() error {
+	group, err := net.ResolveUDPAddr("udp", b.config.Multicast)
+	if err != nil {
+		return err
+	}
+	var ifi *net.Interface
+	if b.config.Interface != "" {
+		if ifi, err = net.InterfaceByName(b.config.Interface); err != nil {
+			return err
+		}
+	}
+	if b.multicast, err = net.ListenMulticastUDP("udp", ifi, group); err != nil {
+		return err
+	}
+	b.multicast.SetReadBuffer(1 << 20)
+	if b.sender, err = net.DialUDP("udp", nil, group); err != nil {
+		return err
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := b.multicast.ReadFromUDP(buf)
+			if err != nil {
+				if !b.isClosed() {
+					log.Printf("Warn - peerbroker: cannot read from multicast group: %v", err)
+				}
+				return
+			}
+			b.receive(append([]byte(nil), buf[:n]...), from)
+		}
+	}()
+	return nil
+}
+
+func (b *Broker) startTCP() error {
+	var err error
+	if b.listener, err = net.Listen("tcp", b.config.Listen); err != nil {
+		return err
+	}
+	b.wg.Add(1)
+	go b.accept()
+
+	if b.config.Peers != nil {
+		b.refreshPeers()
+		if b.config.RefreshInterval > 0 {
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				ticker := time.NewTicker(b.config.RefreshInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						b.refreshPeers()
+					case <-b.done:
+						return
+					}
+				}
+			}()
+		}
+	}
+	return nil
+}
+
+func (b *Broker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			if !b.isClosed() {
+				log.Printf("Warn - peerbroker: cannot accept connection: %v", err)
+			}
+			return
+		}
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			conn.Close()
+			return
+		}
+		b.conns[conn] = struct{}{}
+		b.wg.Add(1)
+		b.mu.Unlock()
+		go b.read(conn)
+	}
+}
+
+// Reads the frames sent by a peer
+func (b *Broker) read(conn net.Conn) {
+	defer b.wg.Done()
+	defer func() {
+		conn.Close()
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+	}()
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > macSize+maxMessageSize {
+			log.Printf("Warn - peerbroker: message from %v too long, closing connection", conn.RemoteAddr())
+			return
+		}
+		signed := make([]byte, size)
+		if _, err := io.ReadFull(conn, signed); err != nil {
+			return
+		}
+		b.receive(signed, conn.RemoteAddr())
+	}
+}
+
+// Resolves the peers, connecting to the new ones and disconnecting from the
+// ones that are gone
+func (b *Broker) refreshPeers() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := b.config.Peers.Peers(ctx)
+	if err != nil {
+		log.Printf("Warn - peerbroker: cannot resolve peers: %v", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	current := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		if b.isSelf(addr) {
+			continue
+		}
+		current[addr] = struct{}{}
+		if _, ok := b.peers[addr]; !ok {
+			p := &peer{addr: addr, queue: make(chan []byte, b.config.QueueSize), stop: make(chan struct{})}
+			b.peers[addr] = p
+			b.wg.Add(1)
+			go b.write(p)
+		}
+	}
+	for addr, p := range b.peers {
+		if _, ok := current[addr]; !ok {
+			close(p.stop)
+			delete(b.peers, addr)
+		}
+	}
+}
+
+// Whether the address is the one the broker listens on
+func (b *Broker) isSelf(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	local := b.listener.Addr().(*net.TCPAddr)
+	if port != strconv.Itoa(local.Port) {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if local.IP.IsUnspecified() {
+		// Listening on all the interfaces
+		addrs, _ := net.InterfaceAddrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return local.IP.Equal(ip)
+}
+
+func (b *Broker) isClosed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// A node the messages are sent to
+type peer struct {
+	addr  string
+	queue chan []byte
+	stop  chan struct{} // Closed when the peer is removed
+}
+
+// Sends the queued messages to the peer, reconnecting when the connection fails
+func (b *Broker) write(p *peer) {
+	defer b.wg.Done()
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	var frame []byte // Not sent yet
+	for {
+		if frame == nil {
+			select {
+			case frame = <-p.queue:
+			case <-p.stop:
+				return
+			case <-b.done:
+				return
+			}
+		}
+		if conn == nil {
+			var err error
+			dialer := net.Dialer{Timeout: 5 * time.Second}
+			if conn, err = dialer.Dial("tcp", p.addr); err != nil {
+				conn = nil
+				log.Printf("Warn - peerbroker: cannot connect to peer %s: %v", p.addr, err)
+				select {
+				case <-time.After(b.config.ReconnectDelay):
+					continue
+				case <-p.stop:
+					return
+				case <-b.done:
+					return
+				}
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(frame); err != nil {
+			// Reconnects and sends the frame again
+			log.Printf("Warn - peerbroker: cannot send message to peer %s: %v", p.addr, err)
+			conn.Close()
+			conn = nil
+			continue
+		}
+		frame = nil
+	}
+}
+
+// To be able to return an anonymous function in Subscribe()
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
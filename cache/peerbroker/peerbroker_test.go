@@ -0,0 +1,219 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package peerbroker
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Peers known once all the brokers listen
+type peerList struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (l *peerList) Peers(ctx context.Context) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.addrs...), nil
+}
+
+func (l *peerList) add(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.addrs = append(l.addrs, addr)
+}
+
+// Messages received by a broker
+type inbox struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (i *inbox) handler(msg []byte) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.messages = append(i.messages, string(msg))
+}
+
+func (i *inbox) wait(t *testing.T, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		i.mu.Lock()
+		if len(i.messages) >= count {
+			messages := append([]string(nil), i.messages...)
+			i.mu.Unlock()
+			return messages
+		}
+		i.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d messages, got %v", count, i.messages)
+	return nil
+}
+
+func (i *inbox) count() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.messages)
+}
+
+func newBroker(t *testing.T, peers *peerList, listen string, secret string) (*Broker, *inbox) {
+	t.Helper()
+	b, err := New(Config{
+		Secret:          []byte(secret),
+		Listen:          listen,
+		Peers:           peers,
+		RefreshInterval: 10 * time.Millisecond,
+		ReconnectDelay:  10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	peers.add(b.Addr().String())
+	in := &inbox{}
+	b.Subscribe(in.handler)
+	return b, in
+}
+
+func TestFanOut(t *testing.T) {
+	peers := &peerList{}
+	b1, in1 := newBroker(t, peers, "127.0.0.1:0", "secret")
+	_, in2 := newBroker(t, peers, "127.0.0.1:0", "secret")
+	_, in3 := newBroker(t, peers, "127.0.0.1:0", "secret")
+	time.Sleep(50 * time.Millisecond) // Peers refreshed
+
+	for _, msg := range []string{"1", "2", "3"} {
+		if err := b1.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, in := range []*inbox{in2, in3} {
+		if messages := in.wait(t, 3); messages[0] != "1" || messages[2] != "3" {
+			t.Errorf("messages should be received in order, got %v", messages)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if in1.count() != 0 {
+		t.Errorf("messages should not be sent to self, got %v", in1.messages)
+	}
+}
+
+func TestInvalidSignature(t *testing.T) {
+	peers := &peerList{}
+	b1, _ := newBroker(t, peers, "127.0.0.1:0", "secret")
+	_, in2 := newBroker(t, peers, "127.0.0.1:0", "secret")
+	_, in3 := newBroker(t, peers, "127.0.0.1:0", "other secret")
+	time.Sleep(50 * time.Millisecond)
+
+	b1.Send([]byte("msg"))
+	in2.wait(t, 1)
+	time.Sleep(50 * time.Millisecond)
+	if in3.count() != 0 {
+		t.Errorf("messages with another secret should be dropped, got %v", in3.messages)
+	}
+}
+
+func TestFrameTooLong(t *testing.T) {
+	b, _ := newBroker(t, &peerList{}, "127.0.0.1:0", "secret")
+	conn, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, macSize+maxMessageSize+1)
+	conn.Write(header)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection should be closed before reading the frame, got %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	peers := &peerList{}
+	b1, _ := newBroker(t, peers, "127.0.0.1:0", "secret")
+	b2, in2 := newBroker(t, peers, "127.0.0.1:0", "secret")
+	time.Sleep(50 * time.Millisecond)
+
+	b1.Send([]byte("1"))
+	in2.wait(t, 1)
+
+	// The peer restarts on the same address
+	addr := b2.Addr().String()
+	b2.Close()
+	b2, err := New(Config{Secret: []byte("secret"), Listen: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Close()
+	in2 = &inbox{}
+	b2.Subscribe(in2.handler)
+
+	// The first messages can be lost with the old connection
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b1.Send([]byte("2"))
+		time.Sleep(20 * time.Millisecond)
+		if in2.count() > 0 {
+			return
+		}
+	}
+	t.Error("messages should be received after the peer restarted")
+}
+
+func TestNoSecret(t *testing.T) {
+	if _, err := New(Config{Listen: "127.0.0.1:0"}); err != ErrNoSecret {
+		t.Errorf("a secret should be required, got %v", err)
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	config := Config{Secret: []byte("secret"), Multicast: "239.255.77.77:17947"}
+	b1, err := New(config)
+	if err != nil {
+		t.Skipf("multicast not available: %v", err)
+	}
+	defer b1.Close()
+	b2, err := New(config)
+	if err != nil {
+		t.Skipf("multicast not available: %v", err)
+	}
+	defer b2.Close()
+	in := &inbox{}
+	b2.Subscribe(in.handler)
+
+	if err := b1.Send([]byte("msg")); err != nil {
+		t.Skipf("multicast not available: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if in.count() > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Skip("multicast messages not delivered on this host")
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// DelPrefix deletes all the entries whose key starts with the prefix, for groups
+// with string keys (for example "tenant:42:"). The other nodes are notified with
+// a single message.
+//
+// Stores that do not implement PrefixStore, but implement Clearer, are cleared.
+// Returns ErrNotSupported if the keys are not strings, or if a store can neither
+// delete by prefix nor be cleared.
+func (g *Group[K, V]) DelPrefix(prefix string) error {
+	if reflect.TypeOf((*K)(nil)).Elem().Kind() != reflect.String {
+		return fmt.Errorf("%w: keys of group %s are not strings", ErrNotSupported, g.name)
+	}
+	if err := g.delPrefixNoFlush(prefix, true); err != nil {
+		return err
+	}
+	cm := g.message(msgPrefix)
+	cm.Prefix = prefix
+	g.send(cm)
+	return nil
+}
+
+func (g *Group[K, V]) delPrefixNoFlush(prefix string, deleteSecondLevel bool) error {
+	g.log("delete prefix %s", prefix)
+	g.tags.delIf(func(key K) bool {
+		return strings.HasPrefix(reflect.ValueOf(key).String(), prefix)
+	})
+	if err := delPrefix(g.store, g.name, prefix); err != nil {
+		return err
+	}
+	if g.store2 == nil || !deleteSecondLevel {
+		return nil
+	}
+	if g.schemaUpgrade != nil { // Otherwise the entries of the previous version would be upgraded again
+		if err := delPrefix(g.store2, g.schemaUpgrade.name, prefix); err != nil {
+			return err
+		}
+	}
+	return delPrefix(g.store2, g.name2, prefix)
+}
+
+func delPrefix(store Store, groupName string, prefix string) error {
+	if ps, ok := store.(PrefixStore); ok {
+		return ps.DelPrefix(groupName, prefix)
+	}
+	if c, ok := store.(Clearer); ok {
+		c.Clear(groupName)
+		return nil
+	}
+	return fmt.Errorf("%w: store cannot delete by prefix", ErrNotSupported)
+}
@@ -0,0 +1,184 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+type RecoveryReason string
+
+const (
+	// Messages from a sender were not received (gap in the sequence numbers)
+	RecoveryGap RecoveryReason = "gap"
+	// The broker reconnected, messages sent while disconnected may have been lost
+	RecoveryReconnect RecoveryReason = "reconnect"
+)
+
+// DisconnectPolicy defines how a group reacts when its broker reports
+// connection events (see ConnectionNotifier)
+type DisconnectPolicy int
+
+const (
+	// Only log a warning (and run the recovery action on reconnect)
+	WarnOnDisconnect DisconnectPolicy = iota
+	// Clear the first level store on reconnect
+	ClearOnReconnect
+	// Do not use the first level store while disconnected, and clear it on reconnect
+	BypassOnDisconnect
+)
+
+// RecoveryEvent describes invalidation messages that a group may have missed.
+// Its first level store can then contain stale entries.
+type RecoveryEvent struct {
+	Group  string // Name of the group
+	Reason RecoveryReason
+	Sender string // Node that sent the missed messages, if known
+	Missed uint64 // Number of missed messages, if known
+	clear  func()
+}
+
+// Clear deletes all the entries of the first level store of the group
+func (e RecoveryEvent) Clear() {
+	e.clear()
+}
+
+// RecoveryAction is run by a group when it may have missed invalidation messages.
+// It can for example clear the group (see ClearOnRecovery), or replay the messages
+// from a durable log.
+//
+// Gaps are detected per sender, which is forgotten after 24 hours without
+// messages: messages missed from a sender silent for longer are not detected.
+type RecoveryAction func(event RecoveryEvent)
+
+// ClearOnRecovery clears the first level store of the group
+var ClearOnRecovery RecoveryAction = func(event RecoveryEvent) {
+	event.Clear()
+}
+
+func (g *Group[K, V]) recover(event RecoveryEvent) {
+	g.warn("missed invalidation messages: %s (sender: %s, missed: %d)", event.Reason, event.Sender, event.Missed)
+	if g.recoveryAction != nil {
+		event.clear = func() { g.clearNoFlush(false) }
+		g.recoveryAction(event)
+	}
+}
+
+// Handles the connection events of the broker
+func (g *Group[K, V]) onConnectionEvent(event ConnectionEvent) {
+	switch event {
+	case Disconnected:
+		g.warn("broker disconnected")
+		g.disconnected.Store(true)
+	case Reconnected:
+		if g.disconnectPolicy != WarnOnDisconnect {
+			g.clearNoFlush(false)
+		}
+		g.disconnected.Store(false)
+		g.recover(RecoveryEvent{Group: g.name, Reason: RecoveryReconnect})
+	}
+}
+
+// Whether the first level store should not be used
+func (g *Group[K, V]) bypass() bool {
+	return g.disconnectPolicy == BypassOnDisconnect && g.disconnected.Load()
+}
+
+// Handles the connection events of the second level store, which may have
+// missed invalidations while disconnected. The first level store is still
+// used meanwhile, as it is then the only one available.
+func (g *Group[K, V]) onSecondLevelEvent(event ConnectionEvent) {
+	switch event {
+	case Disconnected:
+		g.warn("second level store disconnected")
+	case Reconnected:
+		if g.disconnectPolicy != WarnOnDisconnect {
+			g.clearNoFlush(false)
+		}
+		g.recover(RecoveryEvent{Group: g.name, Reason: RecoveryReconnect})
+	}
+}
+
+// Senders that have not sent messages for that long are forgotten, so that the
+// nodes that are gone are not tracked forever. Messages missed from a sender
+// that stayed silent for longer are not detected, as the sender is then heard
+// of for the first time.
+const senderExpiry = 24 * time.Hour
+
+// Sequence numbers of the messages sent and received by a group
+type sequences struct {
+	mu       sync.Mutex
+	sent     uint64             // Last sequence number sent
+	received map[string]*sender // By node
+}
+
+// Encodes a message with the next sequence number, which is only used up if the
+// message is encoded, otherwise receivers would see a gap
+func (s *sequences) encode(cm *Message, codec MessageCodec) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cm.Seq = s.sent + 1
+	msg, err := codec.Encode(cm)
+	if err != nil {
+		return nil, err
+	}
+	s.sent++
+	return msg, nil
+}
+
+type sender struct {
+	seq      uint64 // Last sequence number received
+	lastSeen time.Time
+}
+
+// Records a message received from a node, and returns the number of messages
+// missed since the last one. Messages received out of order are not reported
+// as missed, and messages from a node heard of for the first time neither,
+// as it may have been sending before this group was created, or been
+// forgotten (see senderExpiry).
+func (s *sequences) receive(node string, seq uint64) uint64 {
+	if seq == 0 { // Not sequenced
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.received == nil {
+		s.received = make(map[string]*sender)
+	}
+	last, ok := s.received[node]
+	if !ok {
+		s.expire(now)
+		s.received[node] = &sender{seq: seq, lastSeen: now}
+		return 0
+	}
+	last.lastSeen = now
+	if seq <= last.seq {
+		return 0 // Late or duplicate
+	}
+	missed := seq - last.seq - 1
+	last.seq = seq
+	return missed
+}
+
+func (s *sequences) expire(now time.Time) {
+	for node, sender := range s.received {
+		if now.Sub(sender.lastSeen) > senderExpiry {
+			delete(s.received, node)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func sequencedMessage(group string, node string, seq uint64, key string) []byte {
+	cm := newMessage(msgDel, group, node)
+	cm.Seq = seq
+	cm.Key, _ = BinaryCodec.EncodeKey(key)
+	b, _ := BinaryCodec.Encode(cm)
+	return b
+}
+
+func TestSequences(t *testing.T) {
+	s := sequences{}
+	for _, tc := range []struct {
+		node   string
+		seq    uint64
+		missed uint64
+	}{
+		{"a", 5, 0}, // First message from a node
+		{"a", 6, 0},
+		{"a", 9, 2}, // Gap
+		{"a", 8, 0}, // Late
+		{"b", 1, 0},
+		{"a", 10, 0},
+		{"b", 0, 0}, // Not sequenced
+	} {
+		if missed := s.receive(tc.node, tc.seq); missed != tc.missed {
+			t.Errorf("message %d from %s: %d missed messages expected, got %d", tc.seq, tc.node, tc.missed, missed)
+		}
+	}
+}
+
+func TestSequencesExpiry(t *testing.T) {
+	s := sequences{}
+	s.receive("a", 1)
+	s.received["a"].lastSeen = time.Now().Add(-senderExpiry + time.Minute)
+	if missed := s.receive("a", 3); missed != 1 {
+		t.Errorf("gap after a silence shorter than the expiry should be detected, got %d missed", missed)
+	}
+
+	s.received["a"].lastSeen = time.Now().Add(-senderExpiry - time.Minute)
+	s.receive("b", 1) // Expires a
+	if _, ok := s.received["a"]; ok {
+		t.Errorf("silent sender should be forgotten")
+	}
+}
+
+func TestSequencesEncodeFailure(t *testing.T) {
+	s := sequences{}
+	cm := newMessage(msgDel, "TestSequencesEncodeFailure", newID())
+	cm.Key = []byte("not json") // Cannot be encoded by JSONCodec
+	if _, err := s.encode(cm, JSONCodec); err == nil {
+		t.Fatalf("message should not be encoded")
+	}
+	cm.Key = []byte(`"key"`)
+	if _, err := s.encode(cm, JSONCodec); err != nil || cm.Seq != 1 {
+		t.Errorf("sequence number should be 1 but got %d (%v)", cm.Seq, err)
+	}
+}
+
+func TestRecoveryOnGap(t *testing.T) {
+	var events []RecoveryEvent
+	counter := 0
+	loader := func(key string) (int, error) {
+		counter++
+		return counter, nil
+	}
+	g := NewFactory("TestRecoveryOnGap", loader).WithStore(NewHashMapStore()).WithBroker(&recordingBroker{}).
+		WithRecovery(func(event RecoveryEvent) {
+			events = append(events, event)
+			ClearOnRecovery(event)
+		}).Cache()
+	g.Get("key1")
+	g.Get("key2")
+
+	node := newID()
+	receive(g, sequencedMessage("TestRecoveryOnGap", node, 1, "other"))
+	if v, _ := g.Get("key1"); len(events) != 0 || v != 1 {
+		t.Errorf("no recovery expected, got %v", events)
+	}
+
+	receive(g, sequencedMessage("TestRecoveryOnGap", node, 3, "other"))
+	if len(events) != 1 || events[0].Missed != 1 || events[0].Sender != node || events[0].Reason != RecoveryGap {
+		t.Fatalf("recovery expected for one missed message, got %v", events)
+	}
+	if v, _ := g.Get("key2"); v != 3 {
+		t.Errorf("group should have been cleared, got %v", v)
+	}
+}
+
+// Broker that only reports connection events
+type notifyingBroker struct {
+	handler func(event ConnectionEvent)
+}
+
+func (b *notifyingBroker) Send(msg []byte) error { return nil }
+
+func (b *notifyingBroker) Subscribe(handler func(msg []byte)) (io.Closer, error) { return nil, nil }
+
+func (b *notifyingBroker) OnConnectionEvent(handler func(event ConnectionEvent)) io.Closer {
+	b.handler = handler
+	return closerFunc(func() error {
+		b.handler = nil
+		return nil
+	})
+}
+
+func TestDisconnectPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy            DisconnectPolicy
+		whileDisconnected int // Value read while disconnected
+		afterReconnect    int // Value read after reconnecting
+	}{
+		{WarnOnDisconnect, 1, 1},
+		{ClearOnReconnect, 1, 2},
+		{BypassOnDisconnect, 2, 3},
+	} {
+		broker := &notifyingBroker{}
+		counter := 0
+		loader := func(key string) (int, error) {
+			counter++
+			return counter, nil
+		}
+		var reasons []RecoveryReason
+		g := NewFactory("TestDisconnectPolicy", loader).WithStore(NewHashMapStore()).
+			WithBroker(broker).WithDisconnectPolicy(tc.policy).AllowDuplicates().
+			WithRecovery(func(event RecoveryEvent) { reasons = append(reasons, event.Reason) }).Cache()
+		g.Get("key")
+
+		broker.handler(Disconnected)
+		if v, _ := g.Get("key"); v != tc.whileDisconnected {
+			t.Errorf("policy %d: value while disconnected should be %d, got %v", tc.policy, tc.whileDisconnected, v)
+		}
+		broker.handler(Reconnected)
+		if v, _ := g.Get("key"); v != tc.afterReconnect {
+			t.Errorf("policy %d: value after reconnect should be %d, got %v", tc.policy, tc.afterReconnect, v)
+		}
+		if len(reasons) != 1 || reasons[0] != RecoveryReconnect {
+			t.Errorf("policy %d: recovery action should run on reconnect, got %v", tc.policy, reasons)
+		}
+	}
+}
+
+// Second level store that only reports connection events, and misses
+type notifyingStore struct {
+	Store
+	notifyingBroker
+}
+
+func (s *notifyingStore) Get(key GroupKey) (any, error) { return nil, ErrKeyNotFound }
+
+func TestSecondLevelReconnect(t *testing.T) {
+	store2 := &notifyingStore{Store: NewHashMapStore()}
+	counter := 0
+	loader := func(key string) (int, error) {
+		counter++
+		return counter, nil
+	}
+	var reasons []RecoveryReason
+	g := NewFactory("TestSecondLevelReconnect", loader).WithStore(NewHashMapStore()).
+		WithSecondLevelStore(store2).WithDisconnectPolicy(BypassOnDisconnect).
+		WithRecovery(func(event RecoveryEvent) { reasons = append(reasons, event.Reason) }).Cache()
+	g.Get("key")
+
+	store2.handler(Disconnected)
+	if v, _ := g.Get("key"); v != 1 {
+		t.Errorf("first level should still be used while the second level is disconnected, got %v", v)
+	}
+	store2.handler(Reconnected)
+	if v, _ := g.Get("key"); v != 2 {
+		t.Errorf("first level should be cleared when the second level reconnects, got %v", v)
+	}
+	if len(reasons) != 1 || reasons[0] != RecoveryReconnect {
+		t.Errorf("recovery action should run on reconnect, got %v", reasons)
+	}
+}
+
+func TestCloseUnregistersEventHandlers(t *testing.T) {
+	broker := &notifyingBroker{}
+	loader := func(key string) (int, error) {
+		return 1, nil
+	}
+	g := NewFactory("TestCloseUnregistersEventHandlers", loader).WithStore(NewHashMapStore()).WithBroker(broker).Cache()
+	if broker.handler == nil {
+		t.Fatalf("group should be notified of the connection events")
+	}
+	g.Close()
+	if broker.handler != nil {
+		t.Errorf("closed group should not be notified of the connection events anymore")
+	}
+}
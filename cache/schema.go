@@ -0,0 +1,104 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"reflect"
+)
+
+// Migration of the entries of the second level store written
+// with a previous schema version
+type schemaUpgrade[V any] struct {
+	name      string       // Versioned name of the group for the previous version
+	valueType reflect.Type // Type of the values of the previous version
+	upgrade   func(old any) (V, error)
+}
+
+// Name of a group in the second level store. The schema version is part of
+// the name, so that the stores put it in the key of the entries.
+func versionedName(name string, schemaVersion string) string {
+	if schemaVersion == "" {
+		return name
+	}
+	return name + "@" + schemaVersion
+}
+
+// Reads the entry of the previous schema version from the second level
+// store and converts it. Returns false if there is nothing to upgrade.
+func (g *Group[K, V]) upgrade(key K) (V, bool) {
+	if g.schemaUpgrade == nil || !g.secondLevelHealthy() {
+		return *new(V), false
+	}
+	old, err := g.store2.Get(g.store2.Key(g.schemaUpgrade.name, key))
+	if err != nil {
+		if err != ErrKeyNotFound {
+			g.warn("cannot read previous version of key %v: %v", key, err)
+		}
+		return *new(V), false
+	}
+	v, err := g.schemaUpgrade.upgrade(old)
+	if err != nil {
+		g.warn("cannot upgrade key %v: %v", key, err)
+		return *new(V), false
+	}
+	g.log("upgraded key %v", key)
+	return v, true
+}
+
+// Hash of the shape of a type: kinds, names, fields and struct tags.
+// Two types with the same hash can decode each other's values.
+func schemaHash(t reflect.Type) string {
+	h := fnv.New64a()
+	writeType(h, t, map[reflect.Type]bool{})
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func writeType(w io.Writer, t reflect.Type, seen map[reflect.Type]bool) {
+	if t == nil {
+		io.WriteString(w, "nil;")
+		return
+	}
+	if seen[t] { // Recursive type
+		fmt.Fprintf(w, "ref(%s);", t.String())
+		return
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	fmt.Fprintf(w, "%s(%s)", t.Kind(), t.String())
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice:
+		writeType(w, t.Elem(), seen)
+	case reflect.Array:
+		fmt.Fprintf(w, "[%d]", t.Len())
+		writeType(w, t.Elem(), seen)
+	case reflect.Map:
+		writeType(w, t.Key(), seen)
+		writeType(w, t.Elem(), seen)
+	case reflect.Struct:
+		io.WriteString(w, "{")
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fmt.Fprintf(w, "%s `%s` ", f.Name, f.Tag)
+			writeType(w, f.Type, seen)
+		}
+		io.WriteString(w, "}")
+	}
+	io.WriteString(w, ";")
+}
@@ -0,0 +1,263 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// First byte of a signed message
+const signedMagic = 0xfe
+
+// SigningKeyring holds the HMAC keys of a SigningBroker. Messages are signed with
+// the current key, the other keys are only used to verify messages of the nodes
+// that have not rotated yet.
+type SigningKeyring struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewSigningKeyring creates a keyring with keyID as the current key. Keys should
+// be at least 32 bytes long.
+func NewSigningKeyring(keyID string, key []byte) (*SigningKeyring, error) {
+	k := &SigningKeyring{keys: make(map[string][]byte)}
+	if err := k.Rotate(keyID, key); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Add a key that is only used for verification
+func (k *SigningKeyring) Add(keyID string, key []byte) error {
+	if keyID == "" || len(keyID) > 255 {
+		return fmt.Errorf("invalid key id: '%s'", keyID)
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("empty key: '%s'", keyID)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[keyID] = append([]byte(nil), key...)
+	return nil
+}
+
+// Rotate adds the key and makes it the current key. The previous keys are
+// kept for verification until they are removed.
+func (k *SigningKeyring) Rotate(keyID string, key []byte) error {
+	if err := k.Add(keyID, key); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.current = keyID
+	return nil
+}
+
+// Remove a key from the keyring. Messages signed with that key are then
+// rejected. The current key cannot be removed.
+func (k *SigningKeyring) Remove(keyID string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if keyID != k.current {
+		delete(k.keys, keyID)
+	}
+}
+
+func (k *SigningKeyring) currentKey() (string, []byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+func (k *SigningKeyring) key(keyID string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[keyID]
+	return key, ok
+}
+
+type SigningConfig struct {
+	MaxAge time.Duration // Messages older than that, or that far in the future, are rejected
+
+	// Accepts the messages that are not signed, while the nodes are upgraded
+	AllowUnsigned bool
+}
+
+var DefaultSigningConfig = SigningConfig{MaxAge: 5 * time.Minute}
+
+// RejectedMessages counts the messages rejected by a SigningBroker, by reason
+type RejectedMessages struct {
+	Unsigned   uint64 // Not signed, or malformed
+	UnknownKey uint64 // Signed with a key that is not in the keyring
+	Invalid    uint64 // Signature does not match
+	Expired    uint64 // Timestamp outside of the window
+	Replayed   uint64 // Already received
+}
+
+// SigningBroker decorates a MessageBroker so that the messages are signed with
+// HMAC-SHA256, and the messages that are not signed with a key of the keyring
+// are rejected. Messages are timestamped, and a message received twice or outside
+// of the MaxAge window is rejected as a replay.
+type SigningBroker struct {
+	broker  MessageBroker
+	keyring *SigningKeyring
+	config  SigningConfig
+
+	unsigned, unknownKey, invalid, expired, replayed atomic.Uint64
+}
+
+var (
+	_ MessageBroker      = (*SigningBroker)(nil)
+	_ ConnectionNotifier = (*SigningBroker)(nil)
+)
+
+func NewSigningBroker(broker MessageBroker, keyring *SigningKeyring, config SigningConfig) *SigningBroker {
+	if config.MaxAge <= 0 {
+		config.MaxAge = DefaultSigningConfig.MaxAge
+	}
+	return &SigningBroker{broker: broker, keyring: keyring, config: config}
+}
+
+// Implement MessageBroker
+func (b *SigningBroker) Send(msg []byte) error {
+	keyID, key := b.keyring.currentKey()
+	return b.broker.Send(sign(msg, keyID, key, time.Now()))
+}
+
+// Implement MessageBroker. Only the valid messages reach the handler.
+func (b *SigningBroker) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	seen := &replayCache{window: 2 * b.config.MaxAge} // Per subscription, as each one receives every message
+	return b.broker.Subscribe(func(msg []byte) {
+		if payload, ok := b.verify(msg, seen); ok {
+			handler(payload)
+		}
+	})
+}
+
+// Implement ConnectionNotifier, if the underlying broker does
+func (b *SigningBroker) OnConnectionEvent(handler func(event ConnectionEvent)) io.Closer {
+	if cn, ok := b.broker.(ConnectionNotifier); ok {
+		return cn.OnConnectionEvent(handler)
+	}
+	return noopCloser
+}
+
+// Rejected returns the number of messages rejected since the broker was created
+func (b *SigningBroker) Rejected() RejectedMessages {
+	return RejectedMessages{
+		Unsigned:   b.unsigned.Load(),
+		UnknownKey: b.unknownKey.Load(),
+		Invalid:    b.invalid.Load(),
+		Expired:    b.expired.Load(),
+		Replayed:   b.replayed.Load(),
+	}
+}
+
+// Signed message: magic | len(keyID) | keyID | time (unix ms) | mac | payload.
+// The mac covers the key id, the time and the payload.
+func sign(msg []byte, keyID string, key []byte, now time.Time) []byte {
+	signed := make([]byte, 0, 2+len(keyID)+8+sha256.Size+len(msg))
+	signed = append(signed, signedMagic, byte(len(keyID)))
+	signed = append(signed, keyID...)
+	signed = binary.BigEndian.AppendUint64(signed, uint64(now.UnixMilli()))
+	header := len(signed)
+	signed = mac(key, signed[1:header], msg).Sum(signed)
+	return append(signed, msg...)
+}
+
+func mac(key []byte, header []byte, msg []byte) hash.Hash {
+	h := hmac.New(sha256.New, key)
+	h.Write(header)
+	h.Write(msg)
+	return h
+}
+
+// Returns the payload of a valid message
+func (b *SigningBroker) verify(signed []byte, seen *replayCache) ([]byte, bool) {
+	if len(signed) < 2 || signed[0] != signedMagic {
+		if b.config.AllowUnsigned {
+			return signed, true
+		}
+		return b.reject(&b.unsigned, "message not signed")
+	}
+	idEnd := 2 + int(signed[1])
+	if len(signed) < idEnd+8+sha256.Size {
+		return b.reject(&b.unsigned, "malformed signed message")
+	}
+	keyID := string(signed[2:idEnd])
+	header := signed[1 : idEnd+8]
+	sum := signed[idEnd+8 : idEnd+8+sha256.Size]
+	payload := signed[idEnd+8+sha256.Size:]
+
+	key, ok := b.keyring.key(keyID)
+	if !ok {
+		return b.reject(&b.unknownKey, "message signed with unknown key %s", keyID)
+	}
+	if !hmac.Equal(mac(key, header, payload).Sum(nil), sum) {
+		return b.reject(&b.invalid, "message with invalid signature (key %s)", keyID)
+	}
+	ts := time.UnixMilli(int64(binary.BigEndian.Uint64(signed[idEnd : idEnd+8])))
+	if age := time.Since(ts); age > b.config.MaxAge || age < -b.config.MaxAge {
+		return b.reject(&b.expired, "message sent at %v outside of the window", ts)
+	}
+	if seen.add([sha256.Size]byte(sum)) {
+		return b.reject(&b.replayed, "message replayed")
+	}
+	return payload, true
+}
+
+func (b *SigningBroker) reject(counter *atomic.Uint64, message string, args ...any) ([]byte, bool) {
+	counter.Add(1)
+	log.Printf("Warn - rejected broker message: "+message, args...)
+	return nil, false
+}
+
+// Signatures of the messages received recently, kept between one and two windows
+type replayCache struct {
+	mu       sync.Mutex
+	window   time.Duration
+	current  map[[sha256.Size]byte]struct{}
+	previous map[[sha256.Size]byte]struct{}
+	rotated  time.Time
+}
+
+// Records a signature, and returns true if it was already recorded
+func (c *replayCache) add(digest [sha256.Size]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); c.current == nil || now.Sub(c.rotated) > c.window {
+		c.previous, c.current = c.current, make(map[[sha256.Size]byte]struct{})
+		c.rotated = now
+	}
+	if _, ok := c.current[digest]; ok {
+		return true
+	}
+	if _, ok := c.previous[digest]; ok {
+		return true
+	}
+	c.current[digest] = struct{}{}
+	return false
+}
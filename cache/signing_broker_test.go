@@ -0,0 +1,133 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Broker delivering the messages synchronously
+type syncBroker struct {
+	mu       sync.Mutex
+	handlers []func(msg []byte)
+}
+
+func (b *syncBroker) Send(msg []byte) error {
+	b.mu.Lock()
+	handlers := append([]func(msg []byte){}, b.handlers...)
+	b.mu.Unlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+	return nil
+}
+
+func (b *syncBroker) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+	return closerFunc(func() error { return nil }), nil
+}
+
+func newSigningBrokers(t *testing.T, config SigningConfig) (sender, receiver *SigningBroker, keyring *SigningKeyring, received *[]string) {
+	broker := &syncBroker{}
+	keyring, err := NewSigningKeyring("k1", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender = NewSigningBroker(broker, keyring, config)
+	receiver = NewSigningBroker(broker, keyring, config)
+	received = &[]string{}
+	receiver.Subscribe(func(msg []byte) { *received = append(*received, string(msg)) })
+	return sender, receiver, keyring, received
+}
+
+func TestSigningBroker(t *testing.T) {
+	sender, receiver, _, received := newSigningBrokers(t, DefaultSigningConfig)
+	sender.Send([]byte("msg"))
+	if len(*received) != 1 || (*received)[0] != "msg" {
+		t.Errorf("signed message should be received, got %v", *received)
+	}
+
+	// Unsigned, forged and tampered messages
+	sender.broker.Send([]byte(`{"group":"group","key":"key"}`))
+	forged := sign([]byte("msg"), "k1", []byte("another key"), time.Now())
+	sender.broker.Send(forged)
+	tampered := sign([]byte("msg"), "k1", []byte("0123456789abcdef0123456789abcdef"), time.Now())
+	tampered[len(tampered)-1] = 'x'
+	sender.broker.Send(tampered)
+	sender.broker.Send(sign([]byte("msg"), "k2", []byte("key"), time.Now()))
+
+	if len(*received) != 1 {
+		t.Errorf("invalid messages should be rejected, got %v", *received)
+	}
+	rejected := receiver.Rejected()
+	if rejected.Unsigned != 1 || rejected.Invalid != 2 || rejected.UnknownKey != 1 {
+		t.Errorf("rejected messages should be counted, got %+v", rejected)
+	}
+}
+
+func TestSigningBrokerReplay(t *testing.T) {
+	_, receiver, _, received := newSigningBrokers(t, SigningConfig{MaxAge: time.Minute})
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	msg := sign([]byte("msg"), "k1", key, time.Now())
+	receiver.broker.Send(msg)
+	receiver.broker.Send(msg)
+	receiver.broker.Send(sign([]byte("old"), "k1", key, time.Now().Add(-2*time.Minute)))
+	receiver.broker.Send(sign([]byte("future"), "k1", key, time.Now().Add(2*time.Minute)))
+
+	if len(*received) != 1 {
+		t.Errorf("replayed messages should be rejected, got %v", *received)
+	}
+	if rejected := receiver.Rejected(); rejected.Replayed != 1 || rejected.Expired != 2 {
+		t.Errorf("rejected messages should be counted, got %+v", rejected)
+	}
+}
+
+func TestSigningBrokerRotation(t *testing.T) {
+	sender, receiver, keyring, received := newSigningBrokers(t, DefaultSigningConfig)
+	receiverKeys, _ := NewSigningKeyring("k1", []byte("0123456789abcdef0123456789abcdef"))
+	receiver.keyring = receiverKeys
+
+	// The sender rotates before the receiver knows the new key
+	keyring.Rotate("k2", []byte("fedcba9876543210fedcba9876543210"))
+	sender.Send([]byte("1"))
+	receiverKeys.Add("k2", []byte("fedcba9876543210fedcba9876543210"))
+	sender.Send([]byte("2"))
+
+	// Messages of nodes that have not rotated yet are still accepted
+	receiver.broker.Send(sign([]byte("3"), "k1", []byte("0123456789abcdef0123456789abcdef"), time.Now()))
+	receiverKeys.Rotate("k2", []byte("fedcba9876543210fedcba9876543210"))
+	receiverKeys.Remove("k1")
+	receiver.broker.Send(sign([]byte("4"), "k1", []byte("0123456789abcdef0123456789abcdef"), time.Now()))
+
+	if len(*received) != 2 || (*received)[0] != "2" || (*received)[1] != "3" {
+		t.Errorf("messages should be verified with the keys of the keyring, got %v", *received)
+	}
+}
+
+func TestSigningBrokerAllowUnsigned(t *testing.T) {
+	sender, _, _, received := newSigningBrokers(t, SigningConfig{AllowUnsigned: true})
+	sender.broker.Send([]byte("unsigned"))
+	sender.Send([]byte("signed"))
+	if len(*received) != 2 {
+		t.Errorf("unsigned messages should be accepted, got %v", *received)
+	}
+}
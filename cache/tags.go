@@ -0,0 +1,171 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Index of the tags of the entries loaded by a group. Values read from the
+// second level store are not kept in the first level store, so the entries
+// of the first level store are always loaded locally and the index is complete.
+//
+// Entries expired or evicted from the first level store are not notified: the
+// index is swept when its size has doubled since the previous sweep, so that it
+// stays bounded by twice the number of entries.
+type tagIndex[K comparable] struct {
+	ttl    time.Duration    // Of the entries, if any
+	exists func(key K) bool // Whether the entry is still in the first level store
+
+	mu      sync.Mutex
+	entries map[string]map[K]struct{} // Keys by tag
+	tags    map[K]taggedKey           // Tags by key
+	swept   int                       // Number of keys after the last sweep
+}
+
+type taggedKey struct {
+	tags []string
+	set  time.Time
+}
+
+const (
+	// Minimum number of keys before the index is swept
+	minTagSweep = 1024
+	// Entries set more recently are kept when sweeping, as some stores (ristretto)
+	// only make them visible after a while
+	tagSweepGrace = time.Second
+)
+
+func (t *tagIndex[K]) set(key K, tags []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.delLocked(key)
+	if len(tags) == 0 {
+		return
+	}
+	if t.entries == nil {
+		t.entries = make(map[string]map[K]struct{})
+		t.tags = make(map[K]taggedKey)
+	}
+	if len(t.tags) >= max(2*t.swept, minTagSweep) {
+		t.sweepLocked()
+	}
+	t.tags[key] = taggedKey{tags: tags, set: time.Now()}
+	for _, tag := range tags {
+		if t.entries[tag] == nil {
+			t.entries[tag] = make(map[K]struct{})
+		}
+		t.entries[tag][key] = struct{}{}
+	}
+}
+
+// Removes the keys of the entries that expired or are not in the first level
+// store anymore
+func (t *tagIndex[K]) sweepLocked() {
+	now := time.Now()
+	for key, tk := range t.tags {
+		age := now.Sub(tk.set)
+		if (t.ttl > 0 && age > t.ttl) || (age > tagSweepGrace && t.exists != nil && !t.exists(key)) {
+			t.delLocked(key)
+		}
+	}
+	t.swept = len(t.tags)
+}
+
+func (t *tagIndex[K]) del(key K) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.delLocked(key)
+}
+
+func (t *tagIndex[K]) delLocked(key K) {
+	for _, tag := range t.tags[key].tags {
+		delete(t.entries[tag], key)
+		if len(t.entries[tag]) == 0 {
+			delete(t.entries, tag)
+		}
+	}
+	delete(t.tags, key)
+}
+
+// Removes the keys matching the condition
+func (t *tagIndex[K]) delIf(matches func(key K) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key := range t.tags {
+		if matches(key) {
+			t.delLocked(key)
+		}
+	}
+}
+
+// Keys carrying the tag
+func (t *tagIndex[K]) keys(tag string) []K {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make([]K, 0, len(t.entries[tag]))
+	for key := range t.entries[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (t *tagIndex[K]) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = nil
+	t.tags = nil
+	t.swept = 0
+}
+
+// Whether the entry is in the first level store
+func (g *Group[K, V]) inFirstLevel(key K) bool {
+	_, err := g.store.Get(g.store.Key(g.name, key))
+	return err == nil
+}
+
+func (g *Group[K, V]) setSecondLevel(gk2 GroupKey, v V, tags []string) {
+	if err := g.store2.Set(gk2, v); err != nil {
+		g.warn("cannot set key %v in second level store: %v", gk2.StoreKey, err)
+		return
+	}
+	if ts, ok := g.store2.(TagStore); ok && len(tags) > 0 {
+		if err := ts.SetTags(gk2, tags); err != nil {
+			g.warn("cannot set tags of key %v in second level store: %v", gk2.StoreKey, err)
+		}
+	}
+}
+
+// Deletes the entries carrying the tag. When broadcast is true, the entries
+// are deleted from the second level store as well and the other nodes are notified.
+func (g *Group[K, V]) invalidateTag(tag string, broadcast bool) {
+	g.log("invalidate tag %s", tag)
+	for _, key := range g.tags.keys(tag) {
+		g.delNoFlush(key, broadcast)
+	}
+	if !broadcast {
+		return
+	}
+	if ts, ok := g.store2.(TagStore); ok {
+		if err := ts.DelTag(g.name2, tag); err != nil {
+			g.warn("cannot delete tag %s in second level store: %v", tag, err)
+		}
+	}
+	cm := g.message(msgTag)
+	cm.Tag = tag
+	g.send(cm)
+}
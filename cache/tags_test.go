@@ -0,0 +1,58 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTagIndexSweep(t *testing.T) {
+	evicted := map[int]bool{}
+	index := tagIndex[int]{exists: func(key int) bool { return !evicted[key] }}
+	for i := 0; i < minTagSweep; i++ {
+		index.set(i, []string{"tag"})
+		evicted[i] = i%2 == 0 // Half of the entries are evicted from the store
+	}
+	for key, tk := range index.tags {
+		tk.set = tk.set.Add(-2 * tagSweepGrace)
+		index.tags[key] = tk
+	}
+
+	index.set(minTagSweep, []string{"tag"}) // Sweeps
+	if len(index.tags) != minTagSweep/2+1 || len(index.keys("tag")) != minTagSweep/2+1 {
+		t.Errorf("evicted entries should be removed from the index, got %d keys", len(index.tags))
+	}
+	if _, ok := index.tags[1]; !ok {
+		t.Errorf("entries still in the store should be kept")
+	}
+}
+
+func TestTagIndexSweepTTL(t *testing.T) {
+	index := tagIndex[int]{ttl: time.Minute}
+	for i := 0; i < minTagSweep; i++ {
+		index.set(i, []string{"tag"})
+	}
+	for key, tk := range index.tags {
+		tk.set = tk.set.Add(-2 * time.Minute)
+		index.tags[key] = tk
+	}
+
+	index.set(minTagSweep, []string{"tag"}) // Sweeps
+	if len(index.tags) != 1 {
+		t.Errorf("expired entries should be removed from the index, got %d keys", len(index.tags))
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// TextCodec encodes the keys in their text form, as formatted by fmt.Sprint,
+// which is how the stores usually format them. It lets the invalidations
+// coming from a store, like the Redis client tracking, be mapped back to the
+// keys of the groups. Messages are encoded like BinaryCodec.
+//
+// Keys can be strings, booleans, numbers, or implement encoding.TextUnmarshaler
+// on their pointer, accepting their formatted value.
+var TextCodec MessageCodec = textCodec{}
+
+type textCodec struct{}
+
+func (textCodec) Magic() byte {
+	return 0xcb
+}
+
+func (c textCodec) Encode(m *Message) ([]byte, error) {
+	b, err := BinaryCodec.Encode(m)
+	if err == nil {
+		b[0] = c.Magic()
+	}
+	return b, err
+}
+
+func (c textCodec) Decode(b []byte) (*Message, error) {
+	if len(b) == 0 || b[0] != c.Magic() {
+		return nil, fmt.Errorf("%w: not a text message", ErrInvalidMessage)
+	}
+	binary := append([]byte{BinaryCodec.Magic()}, b[1:]...)
+	return BinaryCodec.Decode(binary)
+}
+
+func (textCodec) EncodeKey(key any) ([]byte, error) {
+	return []byte(fmt.Sprint(key)), nil
+}
+
+func (textCodec) DecodeKey(b []byte, key any) error {
+	v := reflect.ValueOf(key)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("%w: %T is not a pointer", ErrUnsupportedKey, key)
+	}
+	if u, ok := key.(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText(b)
+	}
+
+	v, s := v.Elem(), string(b)
+	var err error
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		i, err = strconv.ParseInt(s, 10, v.Type().Bits())
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		u, err = strconv.ParseUint(s, 10, v.Type().Bits())
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(s, v.Type().Bits())
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedKey, v.Type())
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	return nil
+}
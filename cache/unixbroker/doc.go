@@ -0,0 +1,26 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package unixbroker provides a cache.MessageBroker between the processes of a
+// host, over a Unix domain socket.
+//
+// One of the processes is elected as the hub: it listens on the socket, and
+// forwards the messages of each process to the others. When the hub exits, the
+// other processes elect a new one. The hub can bridge the messages with a cluster
+// broker (Redis, NATS...), so that a single connection per host is used.
+//
+// Only available on Unix systems.
+package unixbroker
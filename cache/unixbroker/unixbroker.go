@@ -0,0 +1,496 @@
+//go:build unix
+
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unixbroker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"sustainyfacts.dev/anycache/cache"
+)
+
+var (
+	ErrClosed       = errors.New("unixbroker: broker closed")
+	ErrNotConnected = errors.New("unixbroker: not connected to the hub")
+)
+
+const (
+	maxMessageSize = 16 << 20
+	writeTimeout   = 5 * time.Second
+
+	// How long the messages sent to the bridge are remembered, to ignore them
+	// when the bridge delivers them back
+	echoWindow = time.Minute
+)
+
+type Config struct {
+	Path       string              // Path of the socket, shared by the processes of the host
+	Bridge     cache.MessageBroker // Optional cluster broker, used by the hub only
+	RetryDelay time.Duration       // Delay before connecting again to the hub
+}
+
+var DefaultConfig = Config{RetryDelay: 100 * time.Millisecond}
+
+// Broker is a cache.MessageBroker between the processes of a host
+type Broker struct {
+	config Config
+
+	mu           sync.Mutex
+	lock         *os.File     // Held by the hub, released when the process exits
+	listener     net.Listener // When hub
+	clients      map[*conn]struct{}
+	hub          *conn // When connected to the hub
+	handlers     map[uint64]func(msg []byte)
+	nextID       uint64
+	bridgeCloser io.Closer
+	sent         map[[sha256.Size]byte]time.Time // Sent to the bridge
+	closed       bool
+
+	connHandlersMu sync.Mutex
+	connHandlers   map[uint64]func(event cache.ConnectionEvent) // By id
+	nextConnID     uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var (
+	_ cache.MessageBroker      = (*Broker)(nil)
+	_ cache.ConnectionNotifier = (*Broker)(nil)
+)
+
+// Connection with a client or with the hub
+type conn struct {
+	net.Conn
+	mu sync.Mutex // Serializes writes
+}
+
+func (c *conn) write(frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.Write(frame)
+	return err
+}
+
+// New connects to the hub of the host, or becomes the hub if there is none
+func New(config Config) (*Broker, error) {
+	if config.Path == "" {
+		return nil, errors.New("unixbroker: path is required")
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = DefaultConfig.RetryDelay
+	}
+	b := &Broker{
+		config:   config,
+		clients:  make(map[*conn]struct{}),
+		handlers: make(map[uint64]func(msg []byte)),
+		sent:     make(map[[sha256.Size]byte]time.Time),
+		done:     make(chan struct{}),
+	}
+
+	// The first election is synchronous, so that messages can be sent once created
+	var c *conn
+	for attempt := 1; ; attempt++ {
+		var err error
+		if _, c, err = b.elect(); err == nil {
+			break
+		} else if attempt == 10 {
+			return nil, err
+		}
+		time.Sleep(config.RetryDelay)
+	}
+	b.hub = c
+	b.wg.Add(1)
+	go b.run(c)
+	return b, nil
+}
+
+// IsHub returns true if this process is the hub of the host
+func (b *Broker) IsHub() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.listener != nil
+}
+
+// Implement cache.MessageBroker
+func (b *Broker) Send(msg []byte) error {
+	if len(msg) > maxMessageSize {
+		return errors.New("unixbroker: message too long")
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	if b.listener != nil {
+		b.mu.Unlock()
+		b.forward(msg, nil)
+		b.sendToBridge(msg)
+		return nil
+	}
+	hub := b.hub
+	b.mu.Unlock()
+	if hub == nil {
+		return ErrNotConnected
+	}
+	if err := hub.write(frame(msg)); err != nil {
+		hub.Close() // The reader elects a new hub
+		return err
+	}
+	return nil
+}
+
+// Implement cache.MessageBroker
+func (b *Broker) Subscribe(handler func(msg []byte)) (io.Closer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+	return closerFunc(func() error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+		return nil
+	}), nil
+}
+
+// Implement cache.ConnectionNotifier. The processes are disconnected while
+// a new hub is elected.
+func (b *Broker) OnConnectionEvent(handler func(event cache.ConnectionEvent)) io.Closer {
+	b.connHandlersMu.Lock()
+	defer b.connHandlersMu.Unlock()
+	if b.connHandlers == nil {
+		b.connHandlers = make(map[uint64]func(event cache.ConnectionEvent))
+	}
+	id := b.nextConnID
+	b.nextConnID++
+	b.connHandlers[id] = handler
+	return closerFunc(func() error {
+		b.connHandlersMu.Lock()
+		defer b.connHandlersMu.Unlock()
+		delete(b.connHandlers, id)
+		return nil
+	})
+}
+
+// Close disconnects from the hub. If this process is the hub, another
+// process takes over.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	if b.listener != nil {
+		b.listener.Close() // Removes the socket
+	}
+	for c := range b.clients {
+		c.Close()
+	}
+	if b.hub != nil {
+		b.hub.Close()
+	}
+	if b.bridgeCloser != nil {
+		b.bridgeCloser.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	if b.lock != nil {
+		b.lock.Close() // Releases the lock, after the socket is removed
+	}
+	return nil
+}
+
+// Becomes the hub if no other process holds the lock, otherwise connects to the hub
+func (b *Broker) elect() (isHub bool, c *conn, err error) {
+	lock, err := os.OpenFile(b.config.Path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return false, nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+		return true, nil, b.becomeHub(lock)
+	}
+	lock.Close()
+
+	nc, err := net.Dial("unix", b.config.Path)
+	if err != nil {
+		return false, nil, err // The hub may not be listening yet
+	}
+	// Waits until the hub forwards the messages to this process
+	var ack [4]byte
+	nc.SetReadDeadline(time.Now().Add(writeTimeout))
+	if _, err := io.ReadFull(nc, ack[:]); err != nil {
+		nc.Close()
+		return false, nil, err
+	}
+	nc.SetReadDeadline(time.Time{})
+	return false, &conn{Conn: nc}, nil
+}
+
+func (b *Broker) becomeHub(lock *os.File) error {
+	os.Remove(b.config.Path) // Left by a previous hub that did not exit cleanly
+	listener, err := net.Listen("unix", b.config.Path)
+	if err != nil {
+		lock.Close()
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lock = lock
+	b.listener = listener
+	if b.closed {
+		listener.Close()
+		return ErrClosed
+	}
+	b.wg.Add(1)
+	go b.accept(listener)
+	if b.config.Bridge != nil {
+		if b.bridgeCloser, err = b.config.Bridge.Subscribe(b.receiveFromBridge); err != nil {
+			log.Printf("Warn - unixbroker: cannot subscribe to bridge: %v", err)
+		}
+	}
+	return nil
+}
+
+// Reads the messages of the hub, and elects a new hub when the connection is lost
+func (b *Broker) run(c *conn) {
+	defer b.wg.Done()
+	connected := true
+	for {
+		if b.IsHub() {
+			if !connected {
+				b.notify(cache.Reconnected)
+			}
+			return
+		}
+		if c != nil {
+			b.mu.Lock()
+			if b.closed {
+				b.mu.Unlock()
+				c.Close()
+				return
+			}
+			b.hub = c
+			b.mu.Unlock()
+			if !connected {
+				connected = true
+				b.notify(cache.Reconnected)
+			}
+
+			b.read(c)
+
+			b.mu.Lock()
+			b.hub = nil
+			b.mu.Unlock()
+			if b.isClosed() {
+				return
+			}
+			connected = false
+			b.notify(cache.Disconnected)
+		}
+
+		select {
+		case <-b.done:
+			return
+		case <-time.After(b.config.RetryDelay):
+		}
+		var err error
+		if _, c, err = b.elect(); err != nil && !b.IsHub() {
+			log.Printf("Warn - unixbroker: cannot connect to hub: %v", err)
+		}
+	}
+}
+
+func (b *Broker) accept(listener net.Listener) {
+	defer b.wg.Done()
+	for {
+		nc, err := listener.Accept()
+		if err != nil {
+			if !b.isClosed() {
+				log.Printf("Warn - unixbroker: cannot accept connection: %v", err)
+			}
+			return
+		}
+		c := &conn{Conn: nc}
+		c.mu.Lock() // The ack is the first frame, before the forwarded messages
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			c.Close()
+			return
+		}
+		b.clients[c] = struct{}{}
+		b.wg.Add(1)
+		b.mu.Unlock()
+		c.SetWriteDeadline(time.Now().Add(writeTimeout))
+		_, err = c.Write(frame(nil))
+		c.mu.Unlock()
+		if err != nil {
+			c.Close()
+		}
+		go func() {
+			defer b.wg.Done()
+			b.read(c)
+			b.mu.Lock()
+			delete(b.clients, c)
+			b.mu.Unlock()
+		}()
+	}
+}
+
+// Reads the frames of a connection until it is closed. The hub forwards the
+// messages of a client to the other clients and to the bridge.
+func (b *Broker) read(c *conn) {
+	defer c.Close()
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(c, header[:]); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxMessageSize {
+			log.Printf("Warn - unixbroker: message too long, closing connection")
+			return
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(c, msg); err != nil {
+			return
+		}
+		if b.IsHub() {
+			b.forward(msg, c)
+			b.sendToBridge(msg)
+		}
+		b.deliver(msg)
+	}
+}
+
+// Sends the message to the clients, except the one it comes from
+func (b *Broker) forward(msg []byte, from *conn) {
+	b.mu.Lock()
+	clients := make([]*conn, 0, len(b.clients))
+	for c := range b.clients {
+		if c != from {
+			clients = append(clients, c)
+		}
+	}
+	b.mu.Unlock()
+	f := frame(msg)
+	for _, c := range clients {
+		if err := c.write(f); err != nil {
+			log.Printf("Warn - unixbroker: cannot send message to process: %v", err)
+			c.Close()
+		}
+	}
+}
+
+func (b *Broker) sendToBridge(msg []byte) {
+	if b.config.Bridge == nil {
+		return
+	}
+	now := time.Now()
+	b.mu.Lock()
+	for digest, t := range b.sent {
+		if now.Sub(t) > echoWindow {
+			delete(b.sent, digest)
+		}
+	}
+	b.sent[sha256.Sum256(msg)] = now
+	b.mu.Unlock()
+	if err := b.config.Bridge.Send(msg); err != nil {
+		log.Printf("Warn - unixbroker: cannot send message to bridge: %v", err)
+	}
+}
+
+// Messages of the other hosts are delivered to the processes of this host.
+// Messages sent by this hub, delivered back by the bridge, are ignored.
+func (b *Broker) receiveFromBridge(msg []byte) {
+	digest := sha256.Sum256(msg)
+	b.mu.Lock()
+	_, echo := b.sent[digest]
+	delete(b.sent, digest)
+	b.mu.Unlock()
+	if echo {
+		return
+	}
+	b.forward(msg, nil)
+	b.deliver(msg)
+}
+
+func (b *Broker) deliver(msg []byte) {
+	b.mu.Lock()
+	handlers := make([]func(msg []byte), 0, len(b.handlers))
+	for _, h := range b.handlers {
+		handlers = append(handlers, h)
+	}
+	b.mu.Unlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+}
+
+func (b *Broker) notify(event cache.ConnectionEvent) {
+	b.connHandlersMu.Lock()
+	handlers := make([]func(cache.ConnectionEvent), 0, len(b.connHandlers))
+	for _, h := range b.connHandlers {
+		handlers = append(handlers, h)
+	}
+	b.connHandlersMu.Unlock()
+	for _, h := range handlers {
+		h(event)
+	}
+}
+
+func (b *Broker) isClosed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func frame(msg []byte) []byte {
+	f := make([]byte, 4, 4+len(msg))
+	binary.BigEndian.PutUint32(f, uint32(len(msg)))
+	return append(f, msg...)
+}
+
+// To be able to return an anonymous function in Subscribe()
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,166 @@
+//go:build unix
+
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package unixbroker
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"sustainyfacts.dev/anycache/cache"
+)
+
+// Messages received by a broker
+type inbox struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (i *inbox) handler(msg []byte) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.messages = append(i.messages, string(msg))
+}
+
+func (i *inbox) count() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.messages)
+}
+
+func (i *inbox) wait(t *testing.T, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if i.count() >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d messages, got %d", count, i.count())
+}
+
+// Socket paths are limited to about 100 characters
+func socketPath(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "ub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "cache.sock")
+}
+
+func newBroker(t *testing.T, config Config) (*Broker, *inbox) {
+	t.Helper()
+	config.RetryDelay = 10 * time.Millisecond
+	b, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	in := &inbox{}
+	b.Subscribe(in.handler)
+	return b, in
+}
+
+func TestForward(t *testing.T) {
+	path := socketPath(t)
+	hub, inHub := newBroker(t, Config{Path: path})
+	b1, in1 := newBroker(t, Config{Path: path})
+	_, in2 := newBroker(t, Config{Path: path})
+	if !hub.IsHub() || b1.IsHub() {
+		t.Fatal("first process should be the hub")
+	}
+
+	b1.Send([]byte("from client"))
+	inHub.wait(t, 1)
+	in2.wait(t, 1)
+
+	hub.Send([]byte("from hub"))
+	in2.wait(t, 2)
+	in1.wait(t, 1)
+	time.Sleep(20 * time.Millisecond)
+	if in1.count() != 1 || inHub.count() != 1 {
+		t.Errorf("messages should not be delivered to their sender, got %v and %v", in1.messages, inHub.messages)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	path := socketPath(t)
+	hub, _ := newBroker(t, Config{Path: path})
+	b1, in1 := newBroker(t, Config{Path: path})
+	b2, in2 := newBroker(t, Config{Path: path})
+	events := make(chan cache.ConnectionEvent, 10)
+	b1.OnConnectionEvent(func(event cache.ConnectionEvent) { events <- event })
+
+	hub.Close()
+	if event := <-events; event != cache.Disconnected {
+		t.Errorf("expected disconnected event, got %v", event)
+	}
+	if event := <-events; event != cache.Reconnected {
+		t.Errorf("expected reconnected event, got %v", event)
+	}
+
+	// One of the processes is the new hub, and the other one connects to it
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && in2.count() == 0 {
+		b1.Send([]byte("after failover"))
+		time.Sleep(20 * time.Millisecond)
+	}
+	if in2.count() == 0 {
+		t.Fatal("messages should be delivered after failover")
+	}
+	if b1.IsHub() == b2.IsHub() {
+		t.Error("exactly one process should be the hub")
+	}
+	b2.Send([]byte("back"))
+	in1.wait(t, 1)
+}
+
+func TestStaleSocket(t *testing.T) {
+	path := socketPath(t)
+	os.WriteFile(path, nil, 0o600) // Left by a process killed without cleanup
+	b, _ := newBroker(t, Config{Path: path})
+	if !b.IsHub() {
+		t.Error("process should be the hub")
+	}
+}
+
+func TestBridge(t *testing.T) {
+	bridge := cache.NewMemoryBroker(cache.DefaultMemoryBrokerConfig)
+	defer bridge.Close()
+
+	// Two hosts, with two processes each
+	pathA, pathB := socketPath(t), socketPath(t)
+	_, inA1 := newBroker(t, Config{Path: pathA, Bridge: bridge})
+	a2, _ := newBroker(t, Config{Path: pathA, Bridge: bridge})
+	_, inB1 := newBroker(t, Config{Path: pathB, Bridge: bridge})
+	_, inB2 := newBroker(t, Config{Path: pathB, Bridge: bridge})
+
+	a2.Send([]byte("msg"))
+	inA1.wait(t, 1)
+	inB1.wait(t, 1)
+	inB2.wait(t, 1)
+	time.Sleep(50 * time.Millisecond)
+	if inA1.count() != 1 || inB1.count() != 1 || inB2.count() != 1 {
+		t.Errorf("messages should be delivered once, got %d, %d and %d", inA1.count(), inB1.count(), inB2.count())
+	}
+}
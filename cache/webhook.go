@@ -0,0 +1,271 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// AllGroups is the group passed to WebhookConfig.Authorize for the tags
+// invalidated in all the groups
+const AllGroups = "*"
+
+type WebhookConfig struct {
+	// Authenticates a request, and returns the name of the caller. Required.
+	Authenticate func(r *http.Request) (caller string, err error)
+	// Whether the caller may invalidate the entries of a group. All the groups when nil.
+	Authorize func(caller string, group string) bool
+
+	IdempotencyTTL time.Duration // How long the idempotency keys are remembered
+	MaxBodySize    int64
+}
+
+var DefaultWebhookConfig = WebhookConfig{IdempotencyTTL: 24 * time.Hour, MaxBodySize: 1 << 20}
+
+// WebhookRequest is the body of the requests of the webhook. Keys are decoded
+// into the key type of the group. Tags without group are invalidated in all
+// the groups.
+type WebhookRequest struct {
+	Group string            `json:"group"`
+	Key   json.RawMessage   `json:"key,omitempty"`
+	Keys  []json.RawMessage `json:"keys,omitempty"`
+	Clear bool              `json:"clear,omitempty"`
+	Tags  []string          `json:"tags,omitempty"`
+}
+
+// BearerTokens authenticates the requests with an "Authorization: Bearer <token>"
+// header, with the tokens mapped to the name of their caller
+func BearerTokens(tokens map[string]string) func(r *http.Request) (string, error) {
+	return func(r *http.Request) (string, error) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return "", ErrUnauthorized
+		}
+		caller := ""
+		for t, c := range tokens { // Compares all the tokens, in constant time
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				caller = c
+			}
+		}
+		if caller == "" {
+			return "", ErrUnauthorized
+		}
+		return caller, nil
+	}
+}
+
+// NewWebhookHandler returns an http.Handler invalidating the entries of the
+// groups of this process, for external systems that can only notify through
+// webhooks. Invalidations are applied like Del, Clear and InvalidateTag: in the
+// first and second level stores, and sent to the other nodes through the broker.
+//
+// Requests are POST requests with a WebhookRequest as JSON body. A request
+// with an Idempotency-Key header already processed is not applied again.
+func NewWebhookHandler(config WebhookConfig) http.Handler {
+	if config.IdempotencyTTL <= 0 {
+		config.IdempotencyTTL = DefaultWebhookConfig.IdempotencyTTL
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = DefaultWebhookConfig.MaxBodySize
+	}
+	return &webhook{config: config, processed: make(map[string]processedRequest)}
+}
+
+type webhook struct {
+	config WebhookConfig
+
+	mu        sync.Mutex
+	processed map[string]processedRequest // By caller and idempotency key
+}
+
+type processedRequest struct {
+	status int
+	at     time.Time
+}
+
+type webhookError struct {
+	status  int
+	message string
+}
+
+func (w *webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		writeWebhookError(rw, webhookError{http.StatusMethodNotAllowed, "method not allowed"})
+		return
+	}
+	if w.config.Authenticate == nil {
+		writeWebhookError(rw, webhookError{http.StatusInternalServerError, "no authentication configured"})
+		return
+	}
+	caller, err := w.config.Authenticate(r)
+	if err != nil {
+		writeWebhookError(rw, webhookError{http.StatusUnauthorized, err.Error()})
+		return
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		if status, ok := w.begin(caller + "\x00" + idempotencyKey); ok {
+			rw.Header().Set("Idempotent-Replayed", "true")
+			rw.WriteHeader(status)
+			return
+		}
+	}
+
+	status := http.StatusNoContent
+	if err := w.apply(caller, r); err != nil {
+		writeWebhookError(rw, *err)
+		status = err.status
+	} else {
+		rw.WriteHeader(status)
+	}
+	if idempotencyKey != "" {
+		w.end(caller+"\x00"+idempotencyKey, status)
+	}
+}
+
+func (w *webhook) apply(caller string, r *http.Request) *webhookError {
+	var req WebhookRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, w.config.MaxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return &webhookError{http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err)}
+	}
+
+	keys := req.Keys
+	if req.Key != nil {
+		keys = append(keys, req.Key)
+	}
+	if req.Group == "" {
+		if len(keys) > 0 || req.Clear || len(req.Tags) == 0 {
+			return &webhookError{http.StatusBadRequest, "group is required, except for tags"}
+		}
+		if !w.authorized(caller, AllGroups) {
+			return &webhookError{http.StatusForbidden, "not authorized for all the groups"}
+		}
+		log.Printf("webhook: %s invalidates tags %v", caller, req.Tags)
+		for _, tag := range req.Tags {
+			InvalidateTag(tag)
+		}
+		return nil
+	}
+	if len(keys) == 0 && !req.Clear && len(req.Tags) == 0 {
+		return &webhookError{http.StatusBadRequest, "nothing to invalidate"}
+	}
+	if !w.authorized(caller, req.Group) {
+		return &webhookError{http.StatusForbidden, fmt.Sprintf("not authorized for group %s", req.Group)}
+	}
+
+	groups := groupsNamed(req.Group)
+	if len(groups) == 0 {
+		return &webhookError{http.StatusNotFound, fmt.Sprintf("unknown group %s", req.Group)}
+	}
+	log.Printf("webhook: %s invalidates group %s", caller, req.Group)
+	for _, g := range groups {
+		if err := g.delJSON(keys); err != nil {
+			return &webhookError{http.StatusBadRequest, err.Error()}
+		}
+		if req.Clear {
+			g.Clear()
+		}
+		for _, tag := range req.Tags {
+			g.invalidateTag(tag, true)
+		}
+	}
+	return nil
+}
+
+func (w *webhook) authorized(caller string, group string) bool {
+	return w.config.Authorize == nil || w.config.Authorize(caller, group)
+}
+
+// Returns the status of the request if it was already processed, otherwise
+// records it as being processed, so that concurrent retries are not applied
+func (w *webhook) begin(key string) (int, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	for k, p := range w.processed {
+		if now.Sub(p.at) > w.config.IdempotencyTTL {
+			delete(w.processed, k)
+		}
+	}
+	if p, ok := w.processed[key]; ok {
+		if p.status == 0 {
+			return http.StatusConflict, true // Still processing
+		}
+		return p.status, true
+	}
+	w.processed[key] = processedRequest{at: now}
+	return 0, false
+}
+
+func (w *webhook) end(key string, status int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if status >= 400 {
+		delete(w.processed, key) // Can be retried once fixed
+		return
+	}
+	w.processed[key] = processedRequest{status: status, at: time.Now()}
+}
+
+func writeWebhookError(rw http.ResponseWriter, err webhookError) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(err.status)
+	json.NewEncoder(rw).Encode(map[string]string{"error": err.message})
+}
+
+func groupsNamed(name string) []registeredGroup {
+	registeredGroupsMu.Lock()
+	defer registeredGroupsMu.Unlock()
+	var groups []registeredGroup
+	for _, g := range registeredGroups {
+		if g.groupName() == name {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+func (g *Group[K, V]) groupName() string {
+	return g.name
+}
+
+// Deletes the keys encoded in JSON, after checking that they all have the key type
+func (g *Group[K, V]) delJSON(encoded []json.RawMessage) error {
+	keys := make([]K, len(encoded))
+	for i, k := range encoded {
+		if err := json.Unmarshal(k, &keys[i]); err != nil {
+			return fmt.Errorf("invalid key %s for group %s: %v", k, g.name, err)
+		}
+	}
+	for _, key := range keys {
+		g.Del(key)
+	}
+	return nil
+}
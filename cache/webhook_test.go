@@ -0,0 +1,132 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newWebhook() http.Handler {
+	return NewWebhookHandler(WebhookConfig{
+		Authenticate: BearerTokens(map[string]string{"token-crm": "crm", "token-admin": "admin"}),
+		Authorize: func(caller string, group string) bool {
+			return caller == "admin" || group == "TestWebhook"
+		},
+	})
+}
+
+func post(h http.Handler, token string, idempotencyKey string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/invalidate", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	if idempotencyKey != "" {
+		r.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	return rw
+}
+
+func TestWebhook(t *testing.T) {
+	broker := &recordingBroker{}
+	counter := 0
+	g := NewFactory("TestWebhook", func(key int) (int, error) {
+		counter++
+		return counter, nil
+	}).WithStore(NewHashMapStore()).WithBroker(broker).Cache()
+	g.Get(1)
+	g.Get(2)
+	g.Get(3)
+	h := newWebhook()
+
+	if rw := post(h, "token-crm", "", `{"group":"TestWebhook","keys":[1,2]}`); rw.Code != http.StatusNoContent {
+		t.Fatalf("request should succeed, got %d: %s", rw.Code, rw.Body)
+	}
+	if v, _ := g.Get(1); v != 4 {
+		t.Errorf("key should be deleted locally, got %v", v)
+	}
+	if v, _ := g.Get(3); v != 3 {
+		t.Errorf("other key should still be cached, got %v", v)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if messages := broker.messages(); len(messages) != 1 || len(messages[0].Keys) != 2 {
+		t.Errorf("keys should be sent to the other nodes, got %v", messages)
+	}
+
+	if rw := post(h, "token-crm", "", `{"group":"TestWebhook","clear":true}`); rw.Code != http.StatusNoContent {
+		t.Fatalf("request should succeed, got %d: %s", rw.Code, rw.Body)
+	}
+	if v, _ := g.Get(3); v != 5 {
+		t.Errorf("group should be cleared, got %v", v)
+	}
+}
+
+func TestWebhookIdempotency(t *testing.T) {
+	counter := 0
+	g := NewFactory("TestWebhookIdempotency", func(key string) (int, error) {
+		counter++
+		return counter, nil
+	}).WithStore(NewHashMapStore()).Cache()
+	h := newWebhook()
+
+	g.Get("key")
+	post(h, "token-admin", "request-1", `{"group":"TestWebhookIdempotency","key":"key"}`)
+	g.Get("key")
+	rw := post(h, "token-admin", "request-1", `{"group":"TestWebhookIdempotency","key":"key"}`)
+	if rw.Code != http.StatusNoContent || rw.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry should be answered without being applied, got %d", rw.Code)
+	}
+	if v, _ := g.Get("key"); v != 2 {
+		t.Errorf("retry should not be applied, got %v", v)
+	}
+}
+
+func TestWebhookErrors(t *testing.T) {
+	NewFactory("TestWebhookErrors", func(key int) (int, error) {
+		return key, nil
+	}).WithStore(NewHashMapStore()).Cache()
+	h := newWebhook()
+
+	for _, test := range []struct {
+		token  string
+		body   string
+		status int
+	}{
+		{"invalid", `{"group":"TestWebhook","key":1}`, http.StatusUnauthorized},
+		{"token-crm", `{"group":"TestWebhookErrors","key":1}`, http.StatusForbidden},
+		{"token-crm", `{"tags":["tag"]}`, http.StatusForbidden},
+		{"token-admin", `{"group":"TestWebhookErrors","key":"not an int"}`, http.StatusBadRequest},
+		{"token-admin", `{"group":"TestWebhookErrors","unknown":1}`, http.StatusBadRequest},
+		{"token-admin", `{"group":"TestWebhookErrors"}`, http.StatusBadRequest},
+		{"token-admin", `{"key":1}`, http.StatusBadRequest},
+		{"token-admin", `{"group":"unknown","key":1}`, http.StatusNotFound},
+		{"token-admin", `{"tags":["tag"]}`, http.StatusNoContent},
+	} {
+		if rw := post(h, test.token, "", test.body); rw.Code != test.status {
+			t.Errorf("%s with %s: expected %d, got %d: %s", test.body, test.token, test.status, rw.Code, rw.Body)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/invalidate", nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("only POST should be allowed, got %d", rw.Code)
+	}
+}
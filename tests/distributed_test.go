@@ -16,7 +16,7 @@ limitations under the License.
 package tests
 
 import (
-	"io"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -31,7 +31,7 @@ func TestDistributedFlush(t *testing.T) {
 		counter++
 		return counter, nil
 	}
-	broker := newSimpleBroker()
+	broker := cache.NewMemoryBroker(cache.DefaultMemoryBrokerConfig)
 	// We use two stores to simulate two nodes with separate in-memory stores
 	group1 := cache.NewFactory("dist-flush", loader).WithBroker(broker).WithStore(cache.NewHashMapStore()).Cache()
 	group2 := cache.NewFactory("dist-flush", loader).WithBroker(broker).WithStore(cache.NewHashMapStore()).AllowDuplicates().Cache()
@@ -60,47 +60,6 @@ func TestDistributedFlush(t *testing.T) {
 	}
 }
 
-type simpleBroker struct {
-	subscribers []func(message []byte)
-}
-
-func newSimpleBroker() *simpleBroker {
-	return &simpleBroker{}
-}
-func (b *simpleBroker) Send(message []byte) error {
-	for _, subscriber := range b.subscribers {
-		// Handle in a go-routine
-		go subscriber(message)
-	}
-	return nil
-}
-
-func (b *simpleBroker) Subscribe(handler func(message []byte)) (io.Closer, error) {
-	b.subscribers = append(b.subscribers, handler)
-	var cf CloserFunc = func() error {
-		for i, h := range b.subscribers {
-			if &h == &handler {
-				b.subscribers = remove(b.subscribers, i)
-				return nil
-			}
-		}
-		panic("subscriber not found")
-	}
-	return cf, nil
-}
-
-func remove[V any](s []V, i int) []V {
-	s[i] = s[len(s)-1]
-	return s[:len(s)-1]
-}
-
-// To be able to return an anonymous function in Subscribe()
-type CloserFunc func() error
-
-func (f CloserFunc) Close() error {
-	return f()
-}
-
 // Test second level store with two distinct in-memory stores and a common
 // 2nd level store, and a message broker for distributed deletes
 func TestSecondLevel(t *testing.T) {
@@ -110,7 +69,7 @@ func TestSecondLevel(t *testing.T) {
 		return counter, nil
 	}
 
-	broker := newSimpleBroker()
+	broker := cache.NewMemoryBroker(cache.DefaultMemoryBrokerConfig)
 	secondLevelStore := cache.NewHashMapStore()
 	group1 := cache.NewFactory("2ndlevel", loader).WithStore(cache.NewHashMapStore()).WithBroker(broker).WithSecondLevelStore(secondLevelStore).Cache()
 	group2 := cache.NewFactory("2ndlevel", loader).WithStore(cache.NewHashMapStore()).WithBroker(broker).WithSecondLevelStore(secondLevelStore).AllowDuplicates().Cache()
@@ -142,3 +101,39 @@ func TestSecondLevel(t *testing.T) {
 	assert.Equal(t, 2, v1, "incorrect value for 'key'")
 	assert.Equal(t, 2, counter, "loader not called again")
 }
+
+// Second level store whose health is set by the test
+type healthStore struct {
+	cache.Store
+	healthy atomic.Bool
+}
+
+func (s *healthStore) Healthy() bool {
+	return s.healthy.Load()
+}
+
+func TestSecondLevelUnhealthy(t *testing.T) {
+	counter := 0
+	loader := func(key string) (int, error) {
+		counter++
+		return counter, nil
+	}
+	secondLevelStore := &healthStore{Store: cache.NewHashMapStore()}
+	group := cache.NewFactory("2ndlevel-unhealthy", loader).WithStore(cache.NewHashMapStore()).WithSecondLevelStore(secondLevelStore).Cache()
+
+	v, _ := group.Get("key")
+	assert.Equal(t, 1, v, "incorrect value for 'key'")
+	time.Sleep(10 * time.Millisecond) // Wait to make sure the second level cache would be set (async)
+	_, err := secondLevelStore.Get(secondLevelStore.Key("2ndlevel-unhealthy", "key"))
+	assert.Equal(t, cache.ErrKeyNotFound, err, "unhealthy second level store not filled")
+
+	secondLevelStore.Set(secondLevelStore.Key("2ndlevel-unhealthy", "set"), 1)
+	assert.NoError(t, group.Set("set", 2), "set with unhealthy second level store")
+	_, err = secondLevelStore.Get(secondLevelStore.Key("2ndlevel-unhealthy", "set"))
+	assert.Equal(t, cache.ErrKeyNotFound, err, "unhealthy second level store not written, previous value deleted")
+
+	secondLevelStore.healthy.Store(true)
+	secondLevelStore.Set(secondLevelStore.Key("2ndlevel-unhealthy", "other"), 42)
+	v, _ = group.Get("other")
+	assert.Equal(t, 42, v, "healthy second level store read")
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"sustainyfacts.dev/anycache/cache"
+)
+
+func TestInvalidator(t *testing.T) {
+	counter := 0
+	loader := func(key int) (int, []string, error) {
+		counter++
+		return counter, []string{"tag"}, nil
+	}
+	broker := cache.NewMemoryBroker(cache.DefaultMemoryBrokerConfig)
+	secondLevelStore := cache.NewHashMapStore()
+	group := cache.NewTaggedFactory("invalidator", loader).WithStore(cache.NewHashMapStore()).
+		WithBroker(broker).WithSecondLevelStore(secondLevelStore).WithSchemaVersion("v2").Cache()
+	other := cache.NewTaggedFactory("invalidator-other", loader).WithStore(cache.NewHashMapStore()).
+		WithBroker(broker).Cache()
+	invalidator := cache.NewInvalidator(broker).WithSecondLevelStore(secondLevelStore, "v2")
+
+	group.Get(1)
+	group.Get(2)
+	group.Get(3)
+	time.Sleep(10 * time.Millisecond) // Wait to make sure the second level cache is set (async)
+
+	err := invalidator.Del("invalidator", 1, 2)
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond) // Wait the message has been propagated
+
+	_, err = secondLevelStore.Get(secondLevelStore.Key("invalidator@v2", 1))
+	assert.Equal(t, cache.ErrKeyNotFound, err, "entry deleted from the second level store")
+	v, _ := group.Get(1)
+	assert.Equal(t, 4, v, "entry deleted")
+	v, _ = group.Get(3)
+	assert.Equal(t, 3, v, "other entry still cached")
+
+	other.Get(1)
+	err = invalidator.InvalidateTag("tag")
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	v, _ = other.Get(1)
+	assert.Equal(t, 6, v, "tag invalidated in all the groups")
+
+	err = invalidator.InvalidateTag("tag", "invalidator")
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	v, _ = group.Get(3)
+	assert.Equal(t, 7, v, "tag invalidated in the group and its second level store")
+
+	err = invalidator.Clear("invalidator-other")
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	v, _ = other.Get(1)
+	assert.Equal(t, 8, v, "group cleared")
+}
@@ -0,0 +1,65 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"sustainyfacts.dev/anycache/cache"
+)
+
+func TestDelPrefix(t *testing.T) {
+	counter := 0
+	loader := func(key string) (int, error) {
+		counter++
+		return counter, nil
+	}
+	broker := cache.NewMemoryBroker(cache.DefaultMemoryBrokerConfig)
+	secondLevelStore := cache.NewHashMapStore()
+	group1 := cache.NewFactory("del-prefix", loader).WithStore(cache.NewHashMapStore()).
+		WithBroker(broker).WithSecondLevelStore(secondLevelStore).Cache()
+	group2 := cache.NewFactory("del-prefix", loader).WithStore(cache.NewHashMapStore()).
+		WithBroker(broker).AllowDuplicates().Cache()
+
+	group1.Get("tenant:42:a")
+	group1.Get("tenant:43:a")
+	group2.Get("tenant:42:b")
+	assert.Equal(t, 3, counter)
+	time.Sleep(10 * time.Millisecond) // Wait to make sure the second level cache is set (async)
+
+	err := group1.DelPrefix("tenant:42:")
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond) // Wait the message has been propagated
+
+	_, err = secondLevelStore.Get(secondLevelStore.Key("del-prefix", "tenant:42:a"))
+	assert.Equal(t, cache.ErrKeyNotFound, err, "entry deleted from the second level store")
+	v, _ := group1.Get("tenant:43:a")
+	assert.Equal(t, 2, v, "entry without the prefix still cached")
+	v, _ = group2.Get("tenant:42:b")
+	assert.Equal(t, 4, v, "entry with the prefix deleted on the other node")
+}
+
+func TestDelPrefixNotString(t *testing.T) {
+	group := cache.NewFactory("del-prefix-int", func(key int) (int, error) {
+		return key, nil
+	}).WithStore(cache.NewHashMapStore()).Cache()
+
+	err := group.DelPrefix("1")
+	assert.True(t, errors.Is(err, cache.ErrNotSupported), "keys are not strings")
+}
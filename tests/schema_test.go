@@ -0,0 +1,97 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tests
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"sustainyfacts.dev/anycache/cache"
+)
+
+type productV1 struct {
+	Name  string
+	Price int
+}
+
+type productV2 struct {
+	Name  string
+	Price float64
+}
+
+// Two versions of the application sharing the same second level store
+func TestSchemaVersion(t *testing.T) {
+	secondLevelStore := cache.NewHashMapStore()
+	loaderV1 := func(key string) (productV1, error) {
+		return productV1{Name: key, Price: 10}, nil
+	}
+	counterV2 := 0
+	loaderV2 := func(key string) (productV2, error) {
+		counterV2++
+		return productV2{Name: key, Price: 9.5}, nil
+	}
+
+	groupV1 := cache.NewFactory("schema-version", loaderV1).WithStore(cache.NewHashMapStore()).
+		WithSecondLevelStore(secondLevelStore).WithAutoSchemaVersion().Cache()
+	groupV2 := cache.NewFactory("schema-version", loaderV2).WithStore(cache.NewHashMapStore()).
+		WithSecondLevelStore(secondLevelStore).WithAutoSchemaVersion().AllowDuplicates().Cache()
+
+	v1, _ := groupV1.Get("book")
+	assert.Equal(t, productV1{Name: "book", Price: 10}, v1)
+
+	time.Sleep(10 * time.Millisecond) // Wait to make sure the second level cache is set (async)
+
+	v2, err := groupV2.Get("book")
+	assert.NoError(t, err)
+	assert.Equal(t, productV2{Name: "book", Price: 9.5}, v2, "entry of the other version should not be visible")
+	assert.Equal(t, 1, counterV2, "loader called")
+}
+
+func TestSchemaUpgrade(t *testing.T) {
+	secondLevelStore := cache.NewHashMapStore()
+	loaderV1 := func(key string) (productV1, error) {
+		return productV1{Name: key, Price: 10}, nil
+	}
+	counterV2 := 0
+	loaderV2 := func(key string) (productV2, error) {
+		counterV2++
+		return productV2{Name: key}, nil
+	}
+	upgrade := func(old any) (productV2, error) {
+		p := old.(productV1)
+		return productV2{Name: p.Name, Price: float64(p.Price)}, nil
+	}
+
+	groupV1 := cache.NewFactory("schema-upgrade", loaderV1).WithStore(cache.NewHashMapStore()).
+		WithSecondLevelStore(secondLevelStore).WithSchemaVersion("1").Cache()
+	groupV2 := cache.NewFactory("schema-upgrade", loaderV2).WithStore(cache.NewHashMapStore()).
+		WithSecondLevelStore(secondLevelStore).WithSchemaVersion("2").
+		WithSchemaUpgrade("1", reflect.TypeOf(productV1{}), upgrade).AllowDuplicates().Cache()
+
+	groupV1.Get("book")
+	time.Sleep(10 * time.Millisecond) // Wait to make sure the second level cache is set (async)
+
+	v2, _ := groupV2.Get("book")
+	assert.Equal(t, productV2{Name: "book", Price: 10}, v2, "entry should be upgraded")
+	assert.Equal(t, 0, counterV2, "loader not called")
+
+	groupV2.Del("book") // Deletes both versions
+	v2, _ = groupV2.Get("book")
+	assert.Equal(t, productV2{Name: "book"}, v2, "entry should be loaded")
+	assert.Equal(t, 1, counterV2, "loader called")
+}
@@ -0,0 +1,57 @@
+/*
+Copyright © 2023 The Authors (See AUTHORS file)
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"sustainyfacts.dev/anycache/cache"
+)
+
+// Entries of several groups related to the same customer
+func TestInvalidateTag(t *testing.T) {
+	counter := 0
+	loader := func(key int) (string, []string, error) {
+		counter++
+		return fmt.Sprintf("value %d", counter), []string{fmt.Sprintf("customer:%d", key)}, nil
+	}
+	secondLevelStore := cache.NewHashMapStore()
+	customers := cache.NewTaggedFactory("tag-customers", loader).WithStore(cache.NewHashMapStore()).
+		WithSecondLevelStore(secondLevelStore).Cache()
+	orders := cache.NewTaggedFactory("tag-orders", loader).WithStore(cache.NewHashMapStore()).Cache()
+
+	customers.Get(1)
+	customers.Get(2)
+	orders.Get(1)
+	assert.Equal(t, 3, counter, "loader called for each entry")
+
+	time.Sleep(10 * time.Millisecond) // Wait to make sure the second level cache is set (async)
+
+	cache.InvalidateTag("customer:1")
+
+	_, err := secondLevelStore.Get(secondLevelStore.Key("tag-customers", 1))
+	assert.Equal(t, cache.ErrKeyNotFound, err, "entry deleted from the second level store")
+
+	v, _ := customers.Get(1)
+	assert.Equal(t, "value 4", v, "entry with the tag reloaded")
+	v, _ = orders.Get(1)
+	assert.Equal(t, "value 5", v, "entry with the tag reloaded")
+	v, _ = customers.Get(2)
+	assert.Equal(t, "value 2", v, "entry without the tag still cached")
+}